@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pacha5065/chartmuseum-migration-tools/chartmuseum2oci/pkg/migrate"
+	"github.com/pkg/errors"
+)
+
+// chartEntry is a Helm chart of a JSON --from-file, compatible with --report-file entries.
+type chartEntry struct {
+	Project string `json:"project"`
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+func (e chartEntry) helmChart() (migrate.HelmChart, error) {
+	if e.Project == "" || e.Name == "" || e.Version == "" {
+		return migrate.HelmChart{}, errors.New("project, name and version are required")
+	}
+	return migrate.HelmChart{Project: e.Project, Name: e.Name, Version: e.Version}, nil
+}
+
+// readChartsFile reads the Helm charts of a --from-file, either a JSON array of
+// charts or one chart per line, as project/name/version or as a JSON object.
+// Empty lines and lines starting with # are ignored, malformed ones skipped.
+func readChartsFile(chartsFile string) ([]migrate.HelmChart, error) {
+	content, err := os.ReadFile(chartsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.HasPrefix(bytes.TrimSpace(content), []byte("[")) {
+		return readChartsArray(content)
+	}
+
+	helmCharts := make([]migrate.HelmChart, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		helmChart, err := parseChartLine(line)
+		if err != nil {
+			slog.Warn("Skipping malformed Helm chart line", "file", chartsFile, "line", lineNumber, "error", err)
+			continue
+		}
+		helmCharts = append(helmCharts, helmChart)
+	}
+
+	return helmCharts, scanner.Err()
+}
+
+func parseChartLine(line string) (migrate.HelmChart, error) {
+	if !strings.HasPrefix(line, "{") {
+		return migrate.ParseChartKey(line)
+	}
+
+	var entry chartEntry
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		return migrate.HelmChart{}, err
+	}
+	return entry.helmChart()
+}
+
+func readChartsArray(content []byte) ([]migrate.HelmChart, error) {
+	var entries []chartEntry
+	if err := json.Unmarshal(content, &entries); err != nil {
+		return nil, err
+	}
+
+	helmCharts := make([]migrate.HelmChart, 0, len(entries))
+	for i, entry := range entries {
+		helmChart, err := entry.helmChart()
+		if err != nil {
+			slog.Warn("Skipping malformed Helm chart entry", "entry", i, "error", err)
+			continue
+		}
+		helmCharts = append(helmCharts, helmChart)
+	}
+	return helmCharts, nil
+}
+
+// writeFailuresFile writes the failed Helm charts of results to failuresFile in
+// the --from-file format, removing it when none failed.
+func writeFailuresFile(failuresFile string, results []migrate.ChartResult) error {
+	var content strings.Builder
+	for _, result := range results {
+		if result.Status == migrate.StatusFailed {
+			helmChart := migrate.HelmChart{Project: result.Project, Name: result.Name, Version: result.Version}
+			content.WriteString(helmChart.Key() + "\n")
+		}
+	}
+
+	if content.Len() == 0 {
+		if err := os.Remove(failuresFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	return os.WriteFile(failuresFile, []byte(content.String()), fileMode)
+}
+
+// startFromChart returns the Helm charts from the one of key onwards, failing
+// when it is not one of them.
+func startFromChart(helmCharts []migrate.HelmChart, key string) ([]migrate.HelmChart, error) {
+	for i, helmChart := range helmCharts {
+		if helmChart.Key() == key {
+			slog.Info("Starting the migration from Helm chart", "chart", key, "skipped", i)
+			return helmCharts[i:], nil
+		}
+	}
+	return nil, errors.Errorf("Helm chart %s is not one of the charts to migrate", key)
+}
+
+// printCharts prints the Helm charts sorted, as a table or as the JSON array
+// of --from-file.
+func printCharts(w io.Writer, helmCharts []migrate.HelmChart, output string) error {
+	helmCharts = append([]migrate.HelmChart(nil), helmCharts...)
+	migrate.SortCharts(helmCharts)
+
+	switch output {
+	case "json":
+		entries := make([]chartEntry, 0, len(helmCharts))
+		for _, helmChart := range helmCharts {
+			entries = append(entries, chartEntry{Project: helmChart.Project, Name: helmChart.Name, Version: helmChart.Version})
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(entries)
+	case "table":
+		table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(table, "PROJECT\tNAME\tVERSION")
+		for _, helmChart := range helmCharts {
+			fmt.Fprintf(table, "%s\t%s\t%s\n", helmChart.Project, helmChart.Name, helmChart.Version)
+		}
+		return table.Flush()
+	default:
+		return errors.Errorf("Invalid output %s, must be json or table", output)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/pacha5065/chartmuseum-migration-tools/chartmuseum2oci/pkg/migrate"
+)
+
+func TestFailuresFileNestedProject(t *testing.T) {
+	failuresPath := filepath.Join(t.TempDir(), "failures.txt")
+	results := []migrate.ChartResult{
+		{Project: "org/team", Name: "mychart", Version: "1.0.0", Status: migrate.StatusFailed},
+		{Project: "org/team", Name: "other", Version: "1.0.0", Status: migrate.StatusMigrated},
+		{Project: "library", Name: "mychart", Version: "2.0.0", Status: migrate.StatusFailed},
+	}
+	if err := writeFailuresFile(failuresPath, results); err != nil {
+		t.Fatal(err)
+	}
+
+	helmCharts, err := readChartsFile(failuresPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []migrate.HelmChart{
+		{Project: "org/team", Name: "mychart", Version: "1.0.0"},
+		{Project: "library", Name: "mychart", Version: "2.0.0"},
+	}
+	if !slices.Equal(helmCharts, want) {
+		t.Errorf("failures file lists Helm charts %+v, want %+v", helmCharts, want)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pacha5065/chartmuseum-migration-tools/chartmuseum2oci/pkg/migrate"
+)
+
+// checkpointBatchSize is the number of Helm charts recorded in a --checkpoint
+// between two syncs of the file, the most a crash may lose.
+const checkpointBatchSize = 10
+
+// checkpoint records the Helm charts successfully migrated or already present
+// in the destination to a --checkpoint file, one JSON chartEntry per line as
+// in a --from-file.
+type checkpoint struct {
+	mutex   sync.Mutex
+	file    *os.File
+	writer  *bufio.Writer
+	pending int
+}
+
+// readCheckpoint returns the keys of the Helm charts recorded in the checkpoint
+// file at checkpointPath, none when it does not exist yet. Malformed lines, e.g.
+// the one of a crash, are ignored.
+func readCheckpoint(checkpointPath string) (map[string]bool, error) {
+	content, err := os.ReadFile(checkpointPath)
+	if os.IsNotExist(err) {
+		return map[string]bool{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	completed := make(map[string]bool)
+	for _, line := range strings.Split(string(content), "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		helmChart, err := parseChartLine(line)
+		if err != nil {
+			slog.Warn("Ignoring malformed checkpoint line", "file", checkpointPath, "error", err)
+			continue
+		}
+		completed[helmChart.Key()] = true
+	}
+	return completed, nil
+}
+
+// skipCompleted returns the Helm charts not recorded as completed.
+func skipCompleted(helmCharts []migrate.HelmChart, completed map[string]bool) []migrate.HelmChart {
+	remaining := make([]migrate.HelmChart, 0, len(helmCharts))
+	for _, helmChart := range helmCharts {
+		if !completed[helmChart.Key()] {
+			remaining = append(remaining, helmChart)
+		}
+	}
+	if skipped := len(helmCharts) - len(remaining); skipped > 0 {
+		slog.Info("Skipping Helm charts completed according to checkpoint", "count", skipped)
+	}
+	return remaining
+}
+
+// openCheckpoint opens the checkpoint file at checkpointPath, the Helm charts
+// being recorded after the ones already there.
+func openCheckpoint(checkpointPath string) (*checkpoint, error) {
+	file, err := os.OpenFile(checkpointPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, fileMode)
+	if err != nil {
+		return nil, err
+	}
+	return &checkpoint{file: file, writer: bufio.NewWriter(file)}, nil
+}
+
+// record records the Helm chart of result unless it failed, syncing the file
+// every checkpointBatchSize charts.
+func (c *checkpoint) record(result migrate.ChartResult) error {
+	if result.Status == migrate.StatusFailed {
+		return nil
+	}
+
+	line, err := json.Marshal(chartEntry{Project: result.Project, Name: result.Name, Version: result.Version})
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, err := c.writer.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if c.pending++; c.pending < checkpointBatchSize {
+		return nil
+	}
+	return c.sync()
+}
+
+func (c *checkpoint) sync() error {
+	if err := c.writer.Flush(); err != nil {
+		return err
+	}
+	c.pending = 0
+	return c.file.Sync()
+}
+
+// Close syncs the Helm charts recorded since the last sync and closes the file.
+func (c *checkpoint) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err := c.sync(); err != nil {
+		c.file.Close()
+		return err
+	}
+	return c.file.Close()
+}
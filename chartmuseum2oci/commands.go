@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Names of the commands, migrate being the default one run when the command
+// line starts with a flag.
+const (
+	commandMigrate = "migrate"
+	commandList    = "list"
+	commandVerify  = "verify"
+	commandVersion = "version"
+)
+
+// command is a subcommand of the tool, taking the root flags shared by all the
+// commands along with its own ones.
+type command struct {
+	name    string
+	summary string
+	// flags registers the flags of the command, besides the root ones, nil
+	// when it has none.
+	flags func()
+	// noRootFlags is set for the commands without the root flags.
+	noRootFlags bool
+}
+
+var commands = []command{
+	{name: commandMigrate, summary: "Migrate the Helm charts from the source to the destinations, the default command", flags: initMigrateFlags},
+	{name: commandList, summary: "Print the Helm charts to migrate, after filtering, without connecting to any destination"},
+	{name: commandVerify, summary: "Check the destinations have the Helm charts of the source, with the same digest, exiting with 7 otherwise", flags: initVerifyFlags},
+	{name: commandVersion, summary: "Print the version of the tool, the commit and Go version it was built with and the helm version", flags: initVersionFlags, noRootFlags: true},
+}
+
+// parseCommand returns the command args start with, along with its arguments,
+// the migrate one when they start with a flag or are empty.
+func parseCommand(args []string) (command, []string, error) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return commands[0], args, nil
+	}
+	for _, cmd := range commands {
+		if cmd.name == args[0] {
+			return cmd, args[1:], nil
+		}
+	}
+
+	names := make([]string, 0, len(commands))
+	for _, cmd := range commands {
+		names = append(names, cmd.name)
+	}
+	return command{}, nil, errors.Errorf("Unknown command %s, must be one of %s", args[0], strings.Join(names, ", "))
+}
+
+// usage returns the flag.Usage of cmd, which lists the commands as well for
+// the default one.
+func (cmd command) usage() func() {
+	return func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "Usage: %s %s [flags]\n\n%s.\n", os.Args[0], cmd.name, cmd.summary)
+		if cmd.name == commandMigrate {
+			fmt.Fprintf(out, "\nCommands:\n")
+			for _, other := range commands {
+				fmt.Fprintf(out, "  %-8s %s\n", other.name, other.summary)
+			}
+			fmt.Fprintf(out, "\nRun %s <command> -h for the flags of a command.\n", os.Args[0])
+		}
+		fmt.Fprintf(out, "\nFlags:\n")
+		flag.PrintDefaults()
+	}
+}
+
+// runVersion runs the version command cmd.
+func runVersion(cmd command, args []string) error {
+	initFlags(cmd)
+	if err := flag.CommandLine.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return &exitError{code: exitConfigError}
+	}
+
+	printVersion(os.Stdout)
+	return nil
+}
+
+// initVersionFlags registers the flags of the version command.
+func initVersionFlags() {
+	flag.StringVar(&helmBinaryPath, "helm-binary", "helm", "Path of the helm binary whose version is printed, looked up in the PATH when it is only a name")
+}
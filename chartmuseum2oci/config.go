@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// Environment variables the credentials flags fall back to when empty.
+const (
+	sourceUsernameEnv      = "SOURCE_HARBOR_USERNAME"
+	sourcePasswordEnv      = "SOURCE_HARBOR_PASSWORD"
+	destinationUsernameEnv = "DEST_HARBOR_USERNAME"
+	destinationPasswordEnv = "DEST_HARBOR_PASSWORD"
+)
+
+// destinationsConfigKey is the --config key of the list of destinations, each
+// of them with its url, username and password or token, as the repeated destination
+// flags.
+const destinationsConfigKey = "destinations"
+
+// envReferenceRegexp matches the ${NAME} references to environment variables of
+// the --config values.
+var envReferenceRegexp = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// configDestination is an entry of the destinations of a --config.
+type configDestination struct {
+	URL      string `yaml:"url"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	Token    string `yaml:"token"`
+}
+
+// loadConfigFile sets the flags from the --config YAML file at configPath, its
+// keys being the flag names, except the ones set on the command line which take
+// precedence and the ones of the flags of other commands which are ignored. The
+// repeatable flags are given as lists, the --map one as a mapping, and ${NAME}
+// in the values is replaced by the NAME environment variable. The flags are set
+// with flag.Set, flag.Visit seeing them as set on the command line.
+func loadConfigFile(configPath string) error {
+	content, err := os.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+
+	var settings map[string]yaml.Node
+	if err := yaml.Unmarshal(content, &settings); err != nil {
+		return errors.Wrap(err, "Failed to parse YAML")
+	}
+
+	setOnCommandLine := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		setOnCommandLine[f.Name] = true
+	})
+
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		node := settings[key]
+		if key == destinationsConfigKey {
+			if err := setConfigDestinations(&node, setOnCommandLine); err != nil {
+				return errors.Wrapf(err, "Invalid %s", key)
+			}
+			continue
+		}
+		if key == "config" || !commandFlags[key] {
+			return errors.Errorf("Unknown setting %s", key)
+		}
+		if flag.Lookup(key) == nil {
+			// The setting of a flag of another command.
+			continue
+		}
+		if setOnCommandLine[key] {
+			continue
+		}
+
+		values, err := configValues(&node)
+		if err != nil {
+			return errors.Wrapf(err, "Invalid %s", key)
+		}
+		for _, value := range values {
+			if value, err = expandEnvReferences(value); err != nil {
+				return errors.Wrapf(err, "Invalid %s", key)
+			}
+			if err := flag.Set(key, value); err != nil {
+				return errors.Wrapf(err, "Invalid %s", key)
+			}
+		}
+	}
+
+	return nil
+}
+
+// configValues returns the flag values of a setting, its items when it is a
+// list and its key:value pairs when it is a mapping.
+func configValues(node *yaml.Node) ([]string, error) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		return []string{node.Value}, nil
+	case yaml.SequenceNode:
+		values := make([]string, 0, len(node.Content))
+		for _, item := range node.Content {
+			if item.Kind != yaml.ScalarNode {
+				return nil, errors.Errorf("line %d: list items must be scalars", item.Line)
+			}
+			values = append(values, item.Value)
+		}
+		return values, nil
+	case yaml.MappingNode:
+		values := make([]string, 0, len(node.Content)/2)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if key.Kind != yaml.ScalarNode || value.Kind != yaml.ScalarNode {
+				return nil, errors.Errorf("line %d: mapping keys and values must be scalars", key.Line)
+			}
+			values = append(values, key.Value+":"+value.Value)
+		}
+		return values, nil
+	default:
+		return nil, errors.Errorf("line %d: unsupported value", node.Line)
+	}
+}
+
+// setConfigDestinations sets the destinations of a --config through the
+// destination flags, unless some of them was set on the command line. The
+// --destination-url of each destination is set first, even when empty, so that
+// it starts a new destination.
+func setConfigDestinations(node *yaml.Node, setOnCommandLine map[string]bool) error {
+	var configDestinations []configDestination
+	if err := node.Decode(&configDestinations); err != nil {
+		return err
+	}
+	if setOnCommandLine["destination-url"] || setOnCommandLine["destination-username"] || setOnCommandLine["destination-password"] || setOnCommandLine["destination-token"] {
+		return nil
+	}
+	if len(destinations) > 0 {
+		return errors.New("destinations and destination-url, destination-username, destination-password or destination-token are mutually exclusive")
+	}
+
+	for i, destination := range configDestinations {
+		for _, field := range []struct{ name, value string }{
+			{"destination-url", destination.URL},
+			{"destination-username", destination.Username},
+			{"destination-password", destination.Password},
+			{"destination-token", destination.Token},
+		} {
+			if field.value == "" && field.name != "destination-url" {
+				continue
+			}
+			value, err := expandEnvReferences(field.value)
+			if err != nil {
+				return errors.Wrapf(err, "destination %d", i+1)
+			}
+			if err := flag.Set(field.name, value); err != nil {
+				return errors.Wrapf(err, "destination %d", i+1)
+			}
+		}
+	}
+	return nil
+}
+
+// expandEnvReferences replaces the ${NAME} references of value by the value of
+// the NAME environment variable, which must be set.
+func expandEnvReferences(value string) (string, error) {
+	var err error
+	expanded := envReferenceRegexp.ReplaceAllStringFunc(value, func(reference string) string {
+		name := envReferenceRegexp.FindStringSubmatch(reference)[1]
+		envValue, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = errors.Errorf("environment variable %s is not set", name)
+		}
+		return envValue
+	})
+	return expanded, err
+}
+
+// loadCredentialsEnv sets the empty credentials of the source and of the first
+// destination from their environment variables, if set.
+func loadCredentialsEnv() {
+	setFromEnv(&sourceHarborUsername, sourceUsernameEnv)
+	setFromEnv(&sourceHarborPassword, sourcePasswordEnv)
+	if len(destinations) > 0 {
+		setFromEnv(&destinations[0].Username, destinationUsernameEnv)
+		setFromEnv(&destinations[0].Password, destinationPasswordEnv)
+	}
+}
+
+func setFromEnv(value *string, name string) {
+	if *value == "" {
+		*value = os.Getenv(name)
+	}
+}
+
+// sourceTokenRefresher returns the refresher of the source token reading the
+// --source-token-file again, nil without one.
+func sourceTokenRefresher() func(context.Context) (string, error) {
+	if sourceTokenFile == "" {
+		return nil
+	}
+	return func(context.Context) (string, error) {
+		return readTokenFile(sourceTokenFile)
+	}
+}
+
+// readTokenFile returns the token held by the file at tokenPath, without its
+// surrounding whitespace.
+func readTokenFile(tokenPath string) (string, error) {
+	content, err := os.ReadFile(tokenPath)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(content))
+	if token == "" {
+		return "", errors.Errorf("%s is empty", tokenPath)
+	}
+	return token, nil
+}
+
+// readProjectsFile returns the projects listed by the --projects-file at
+// projectsPath, one per line. Empty lines and comments, from a # to the end of
+// the line, are ignored.
+func readProjectsFile(projectsPath string) ([]string, error) {
+	content, err := os.ReadFile(projectsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var projects []string
+	for _, line := range strings.Split(string(content), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		if line = strings.TrimSpace(line); line != "" {
+			projects = append(projects, line)
+		}
+	}
+	if len(projects) == 0 {
+		// No project would mean all of them.
+		return nil, errors.Errorf("%s lists no project", projectsPath)
+	}
+	return projects, nil
+}
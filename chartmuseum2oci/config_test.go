@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestLoadConfigFileSetsFlags(t *testing.T) {
+	t.Setenv("TEST_DEST_TOKEN", "token")
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	config := `source-url: https://source.example.com
+project: [library, team-a]
+destinations:
+  - url: https://harbor-1.example.com
+    username: admin
+    password: secret
+  - url: https://harbor-2.example.com
+    token: ${TEST_DEST_TOKEN}
+`
+	if err := os.WriteFile(configPath, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	initFlags(commands[0])
+	flag.CommandLine.SetOutput(io.Discard)
+	if err := flag.CommandLine.Parse([]string{"--project", "other"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfigFile(configPath); err != nil {
+		t.Fatal(err)
+	}
+
+	var set []string
+	flag.Visit(func(f *flag.Flag) {
+		set = append(set, f.Name)
+	})
+	want := []string{"destination-password", "destination-token", "destination-url", "destination-username", "project", "source-url"}
+	if !slices.Equal(set, want) {
+		t.Errorf("set flags are %q, want %q", set, want)
+	}
+
+	if sourceHarborURL != "https://source.example.com" {
+		t.Errorf("--source-url is %s, want https://source.example.com", sourceHarborURL)
+	}
+	if !slices.Equal(projectsToMigrate, []string{"other"}) {
+		t.Errorf("--project is %q, want the command line one", projectsToMigrate)
+	}
+	wantDestinations := DestinationsFlag{
+		{URL: "https://harbor-1.example.com", Username: "admin", Password: "secret"},
+		{URL: "https://harbor-2.example.com", Token: "token"},
+	}
+	if !slices.Equal(destinations, wantDestinations) {
+		t.Errorf("destinations are %+v, want %+v", destinations, wantDestinations)
+	}
+}
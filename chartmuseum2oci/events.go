@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/pacha5065/chartmuseum-migration-tools/chartmuseum2oci/pkg/migrate"
+)
+
+// Types of the --events.
+const (
+	eventRunStart   = "run_start"
+	eventChartStart = "chart_start"
+	eventChartDone  = "chart_done"
+	eventRunEnd     = "run_end"
+)
+
+// eventHeader starts every event.
+type eventHeader struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+}
+
+// runStartEvent identifies the build of the tool along with the number of Helm
+// charts to migrate.
+type runStartEvent struct {
+	eventHeader
+	Charts      int    `json:"charts"`
+	ToolVersion string `json:"toolVersion"`
+	Commit      string `json:"commit"`
+}
+
+type chartStartEvent struct {
+	eventHeader
+	Project string `json:"project"`
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// chartDoneEvent has the fields of the --report-file entries.
+type chartDoneEvent struct {
+	eventHeader
+	migrate.ChartResult
+}
+
+type runEndEvent struct {
+	eventHeader
+	runTotals
+}
+
+// eventStream writes the --events to w, one JSON object per line, from any
+// goroutine.
+type eventStream struct {
+	mutex   sync.Mutex
+	encoder *json.Encoder
+}
+
+func newEventStream(w io.Writer) *eventStream {
+	return &eventStream{encoder: json.NewEncoder(w)}
+}
+
+func (s *eventStream) runStarted(count int) {
+	s.emit(runStartEvent{eventHeader: s.header(eventRunStart), Charts: count, ToolVersion: version, Commit: buildCommit()})
+}
+
+func (s *eventStream) chartStarted(helmChart migrate.HelmChart) {
+	s.emit(chartStartEvent{eventHeader: s.header(eventChartStart), Project: helmChart.Project, Name: helmChart.Name, Version: helmChart.Version})
+}
+
+func (s *eventStream) chartDone(result migrate.ChartResult) {
+	s.emit(chartDoneEvent{eventHeader: s.header(eventChartDone), ChartResult: result})
+}
+
+func (s *eventStream) runEnded(totals runTotals) {
+	s.emit(runEndEvent{eventHeader: s.header(eventRunEnd), runTotals: totals})
+}
+
+func (s *eventStream) header(event string) eventHeader {
+	return eventHeader{Event: event, Time: time.Now().UTC()}
+}
+
+func (s *eventStream) emit(event any) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.encoder.Encode(event); err != nil {
+		slog.Error("Failed to write event", "error", err)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	logFormat string
+	logLevel  slog.Level
+	logOutput string
+	quiet     bool
+)
+
+// setupLogger makes the default logger a --log-format one writing to --log-output
+// the records of at least --log-level, debug ones included with --verbose and
+// info ones excluded with --quiet.
+func setupLogger() error {
+	if verbose && quiet {
+		return errors.New("--verbose and --quiet are mutually exclusive")
+	}
+	if verbose {
+		logLevel = slog.LevelDebug
+	}
+	if quiet && logLevel < slog.LevelWarn {
+		logLevel = slog.LevelWarn
+	}
+
+	var writer io.Writer
+	switch logOutput {
+	case "stdout":
+		writer = os.Stdout
+		if listOnly || verifyOnly || output == "json" || emitEvents {
+			// The listing, the drifts, the JSON summary or the events are
+			// written to stdout.
+			writer = os.Stderr
+		}
+	case "stderr":
+		writer = os.Stderr
+	default:
+		return errors.Errorf("Invalid --log-output %s, must be stdout or stderr", logOutput)
+	}
+
+	options := &slog.HandlerOptions{Level: logLevel, ReplaceAttr: replaceErrorAttr}
+	var handler slog.Handler
+	switch logFormat {
+	case "text":
+		handler = slog.NewTextHandler(writer, options)
+	case "json":
+		handler = slog.NewJSONHandler(writer, options)
+	default:
+		return errors.Errorf("Invalid --log-format %s, must be text or json", logFormat)
+	}
+
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// replaceErrorAttr logs errors as their message, the handlers formatting them
+// with %+v which includes the stack trace of github.com/pkg/errors ones.
+func replaceErrorAttr(_ []string, attr slog.Attr) slog.Attr {
+	if err, ok := attr.Value.Any().(error); ok {
+		attr.Value = slog.StringValue(err.Error())
+	}
+	return attr
+}
+
+// progressOutput returns the stream the progress bar is written to, the one
+// the logs are not written to.
+func progressOutput() *os.File {
+	if logOutput == "stderr" {
+		return os.Stdout
+	}
+	return os.Stderr
+}
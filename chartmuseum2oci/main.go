@@ -1,170 +1,935 @@
 package main
 
 import (
-	"bytes"
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
+	"math/rand"
 	"net/http"
-	"net/url"
 	"os"
-	"os/exec"
+	"os/signal"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
-	"github.com/goharbor/go-client/pkg/harbor"
-	assistClient "github.com/goharbor/go-client/pkg/sdk/assist/client"
-	"github.com/goharbor/go-client/pkg/sdk/v2.0/client"
-	"github.com/goharbor/go-client/pkg/sdk/v2.0/client/project"
+	"github.com/Masterminds/semver/v3"
+	"github.com/pacha5065/chartmuseum-migration-tools/chartmuseum2oci/pkg/migrate"
 	"github.com/pkg/errors"
 	"github.com/schollz/progressbar/v3"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"golang.org/x/net/http/httpguts"
 )
 
-type HelmChart struct {
-	Name    string
-	Project string
-	Version string
+// StringListFlag is the value of a flag which can be specified multiple times.
+type StringListFlag []string
+
+func (values *StringListFlag) String() string {
+	return fmt.Sprint(*values)
 }
 
-func (hc HelmChart) ChartFileName() string {
-	return fmt.Sprintf("%s-%s.tgz", hc.Name, hc.Version)
+func (values *StringListFlag) Set(value string) error {
+	*values = append(*values, value)
+	return nil
 }
 
 type ProjectsToMigrateList []string
 
+func (projects *ProjectsToMigrateList) String() string {
+	return fmt.Sprint(*projects)
+}
+
+func (projects *ProjectsToMigrateList) Set(project string) error {
+	*projects = append(*projects, project)
+	return nil
+}
+
+// DestinationsFlag is the value of the --destination-url, --destination-username
+// and --destination-password flags, which can be repeated to migrate to several
+// Harbor, each of them starting a new destination when the current one already
+// has its value.
+type DestinationsFlag []migrate.HarborOptions
+
+// field returns the flag.Func setting the field of the current destination.
+func (destinations *DestinationsFlag) field(field func(*migrate.HarborOptions) *string) func(string) error {
+	return func(value string) error {
+		if len(*destinations) == 0 || *field(&(*destinations)[len(*destinations)-1]) != "" {
+			*destinations = append(*destinations, migrate.HarborOptions{})
+		}
+		*field(&(*destinations)[len(*destinations)-1]) = value
+		return nil
+	}
+}
+
+// SizeFlag is the value of a flag which is a number of bytes, with an optional
+// K, M, G or T binary unit suffix, e.g. 512M or 512MiB.
+type SizeFlag int64
+
+var sizeRegexp = regexp.MustCompile(`^(\d+)([KMGT]?)(?:I?B)?$`)
+
+func (size *SizeFlag) String() string {
+	return migrate.FormatSize(int64(*size))
+}
+
+func (size *SizeFlag) Set(value string) error {
+	match := sizeRegexp.FindStringSubmatch(strings.ToUpper(value))
+	if match == nil {
+		return errors.Errorf("invalid size %s, expected a number of bytes with an optional K, M, G or T suffix", value)
+	}
+	parsed, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil {
+		return err
+	}
+
+	// Each unit is 1024 times the previous one, no unit meaning bytes.
+	*size = SizeFlag(parsed << (10 * strings.Index(" KMGT", match[2])))
+	return nil
+}
+
+// BandwidthFlag is the value of a flag which is a number of bytes per second, as
+// a SizeFlag with an optional /s suffix, e.g. 10M/s.
+type BandwidthFlag SizeFlag
+
+func (bandwidth *BandwidthFlag) String() string {
+	return (*SizeFlag)(bandwidth).String() + "/s"
+}
+
+func (bandwidth *BandwidthFlag) Set(value string) error {
+	return (*SizeFlag)(bandwidth).Set(strings.TrimSuffix(strings.TrimSuffix(value, "/s"), "/S"))
+}
+
+const fileMode = 0o600
+
+// Exit codes of a migration exceeding the --fail-threshold, of invalid flags or
+// settings, of rejected credentials and of a verify command finding drifts,
+// other errors and interruptions exiting with 1.
 const (
-	fileMode        = 0o600
-	helmBinaryPath  = "helm"
-	timeout         = 5 * time.Second
-	defaultPageSize = 10
+	exitSomeChartsFailed = 2
+	exitAllChartsFailed  = 3
+	exitDeadlineExceeded = 4
+	exitConfigError      = 5
+	exitAuthError        = 6
+	exitDriftFound       = 7
 )
 
+// exitError is an error of run exiting with code, err being nil when it was
+// already logged.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	if e.err == nil {
+		return fmt.Sprintf("exit code %d", e.code)
+	}
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// exitCode logs err, unless already logged, and returns the code to exit with,
+// exitAuthError when credentials were rejected.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	var exitErr *exitError
+	if errors.As(err, &exitErr) && exitErr.err == nil {
+		return exitErr.code
+	}
+	slog.Error(err.Error())
+	switch {
+	case exitErr != nil:
+		return exitErr.code
+	case errors.Is(err, migrate.ErrInvalidCredentials):
+		return exitAuthError
+	default:
+		return 1
+	}
+}
+
+var errDeadlineExceeded = errors.New("--deadline exceeded")
+
+// errVersionPrinted is returned by parseFlags once --version printed the
+// version, exiting with 0.
+var errVersionPrinted = errors.New("version printed")
+
+// errUsage is returned by parseFlags for invalid command line arguments, the
+// flag package printing their error along with the usage.
+var errUsage = errors.New("invalid command line arguments")
+
 var (
-	sourceHarborURL      string
-	sourceHarborUsername string
-	sourceHarborPassword string
-	destinationHarborURL string
-	destinationHarborUsername string
-	destinationHarborPassword string
-	destPath          string
-	projectsToMigrate ProjectsToMigrateList
+	sourceHarborURL        string
+	sourceHarborUsername   string
+	sourceHarborPassword   string
+	sourceToken            string
+	sourceTokenFile        string
+	destinations           DestinationsFlag
+	destPath               string
+	projectsToMigrate      ProjectsToMigrateList
+	projectsFile           string
+	projectsToExclude      StringListFlag
+	allProjects            bool
+	flatten                bool
+	concurrency            int
+	perProjectConcurrency  int
+	pullTimeout            time.Duration
+	loginTimeout           time.Duration
+	chartTimeout           time.Duration
+	deadline               time.Duration
+	maxRetries             int
+	verbose                bool
+	overwrite              bool
+	dryRun                 bool
+	listOnly               bool
+	verifyOnly             bool
+	showVersion            bool
+	countCheck             bool
+	output                 string
+	insecureSkipTLSVerify  bool
+	caCertFiles            StringListFlag
+	clientCertFile         string
+	clientKeyFile          string
+	proxyURL               string
+	userAgent              string
+	sourceHeaders          = make(http.Header)
+	minFreeSpace           SizeFlag
+	maxChartSize           SizeFlag
+	maxBandwidth           BandwidthFlag
+	keepCharts             bool
+	workDir                string
+	reportFile             string
+	metricsAddr            string
+	pushgatewayURL         string
+	pushgatewayJob         string
+	otlpEndpoint           string
+	emitEvents             bool
+	webhookURL             string
+	webhookOn              string
+	failuresFile           string
+	chartsFile             string
+	keepChartsDir          string
+	createProjects         bool
+	requireDestProjects    bool
+	allowCollisions        bool
+	createPublicProjects   bool
+	includeInvalidVersions bool
+	caseSensitiveNames     bool
+	latestVersions         int
+	failThreshold          int
+	failFast               bool
+	maxConsecutiveFailures int
+	skipVerifyDigest       bool
+	verifyPush             bool
+	deleteSource           bool
+	shuffle                bool
+	limit                  int
+	startFrom              string
+	checkpointFile         string
+	confirmDelete          bool
+	validateCharts         bool
+	helmBinaryPath         string
+	pusher                 string
+	annotateMigration      bool
+	sourceType             string
+	sourceAPI              string
+	configFile             string
+	destinationType        string
+	skipPrereleases        bool
+	versionConstraint      *semver.Constraints
+	nameFilters            StringListFlag
+	nameRegexps            StringListFlag
+	projectMapping         = make(map[string]string)
+	imageRewrites          = make(map[string]string)
+	dependencyRewrites     = make(map[string]string)
+	nameRewrites           []migrate.NameRewrite
+	rewriteDependencies    bool
 )
 
-func init() {
-	initFlags()
+// commandFlags are the names of the flags of every command, the settings of the
+// --config file for the flags of the other commands being ignored.
+var commandFlags map[string]bool
+
+// initFlags registers the root flags along with the ones of cmd on a new
+// flag.CommandLine, resetting the values of the repeatable ones, so that they
+// can be parsed again. The flags of all the commands are registered on a
+// discarded flag set first, the ones cmd does not have keeping their default
+// value.
+func initFlags(cmd command) {
+	commandFlags = make(map[string]bool)
+	for _, other := range commands {
+		flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+		initRootFlags()
+		if other.flags != nil {
+			other.flags()
+		}
+		flag.VisitAll(func(f *flag.Flag) {
+			commandFlags[f.Name] = true
+		})
+	}
+
+	flag.CommandLine = flag.NewFlagSet(os.Args[0]+" "+cmd.name, flag.ContinueOnError)
+	flag.CommandLine.Usage = cmd.usage()
+	destinations = nil
+	projectsToMigrate = nil
+	projectsToExclude = nil
+	caCertFiles = nil
+	nameFilters = nil
+	nameRegexps = nil
+	nameRewrites = nil
+	versionConstraint = nil
+	projectMapping = make(map[string]string)
+	imageRewrites = make(map[string]string)
+	dependencyRewrites = make(map[string]string)
+	sourceHeaders = make(http.Header)
+	flagErrors = nil
+	maxChartSize = 0
+	maxBandwidth = 0
+	minFreeSpace = 0
+
+	if !cmd.noRootFlags {
+		initRootFlags()
+	}
+	if cmd.flags != nil {
+		cmd.flags()
+	}
 }
 
-func initFlags() {
-	flag.StringVar(&sourceHarborURL, "source-url", "", "Source Harbor registry URL")
-	flag.StringVar(&sourceHarborUsername, "source-username", "", "Source Harbor registry username")
-	flag.StringVar(&sourceHarborPassword, "source-password", "", "Source Harbor registry password")
-	flag.StringVar(&destinationHarborURL, "destination-url", "", "Destination Harbor registry URL")
-	flag.StringVar(&destinationHarborUsername, "destination-username", "", "Destination Harbor registry username")
-	flag.StringVar(&destinationHarborPassword, "destination-password", "", "Destination Harbor registry password")
-	flag.StringVar(&destPath, "destpath", "", "Destination subpath")
+// initRootFlags registers the flags shared by the commands, selecting the Helm
+// charts of the source and destinations and setting up the connections to them
+// and the logs.
+func initRootFlags() {
+	flag.StringVar(&configFile, "config", "", "Path of a YAML file of settings named as the flags, which take precedence over it")
+	flag.StringVar(&sourceType, "source-type", migrate.SourceTypeHarbor, "Type of the source, harbor for the ChartMuseum of a Harbor or chartmuseum for a standalone ChartMuseum")
+	flag.StringVar(&sourceAPI, "source-api", migrate.SourceAPIChartRepo, "API the Helm charts of a harbor source are listed with, v1 for its ChartMuseum or v2 for its chart artifacts, pulled from its OCI registry, e.g. once ChartMuseum is disabled")
+	flag.StringVar(&sourceHarborURL, "source-url", "", "Source Harbor registry or ChartMuseum URL")
+	flag.StringVar(&sourceHarborUsername, "source-username", "", "Source Harbor registry username, "+sourceUsernameEnv+" by default")
+	flag.StringVar(&sourceHarborPassword, "source-password", "", "Source Harbor registry password, "+sourcePasswordEnv+" by default")
+	flag.StringVar(&sourceToken, "source-token", "", "Bearer token authenticating to the source instead of --source-username and --source-password, e.g. with SSO")
+	flag.StringVar(&sourceTokenFile, "source-token-file", "", "Path of a file holding the --source-token, read again to refresh it when the source rejects it")
+	flag.StringVar(&destinationType, "destination-type", migrate.DestinationTypeHarbor, "Type of the destination, harbor for the OCI registry of a Harbor or dir for a Helm repository per project in the --destpath directory")
+	flag.Func("destination-url", "Destination Harbor registry URL, can be specified multiple times to push to every destination", destinations.field(func(d *migrate.HarborOptions) *string { return &d.URL }))
+	flag.Func("destination-username", "Destination Harbor registry username, following the --destination-url it applies to when there are several, "+destinationUsernameEnv+" by default for the first one", destinations.field(func(d *migrate.HarborOptions) *string { return &d.Username }))
+	flag.Func("destination-password", "Destination Harbor registry password, following the --destination-url it applies to when there are several, "+destinationPasswordEnv+" by default for the first one", destinations.field(func(d *migrate.HarborOptions) *string { return &d.Password }))
+	flag.Func("destination-token", "Bearer token authenticating to the destination instead of --destination-username and --destination-password, requiring --pusher oci", destinations.field(func(d *migrate.HarborOptions) *string { return &d.Token }))
+	flag.StringVar(&destPath, "destpath", "", "Destination subpath, or directory of a dir destination")
 	flag.Var(&projectsToMigrate, "project", "Name of the project(s) to migrate")
-	flag.Parse()
+	flag.StringVar(&projectsFile, "projects-file", "", "Path of a file listing projects to migrate, one per line with # comments, along with the --project ones")
+	flag.BoolVar(&flatten, "flatten", false, "Push the Helm charts of all the source projects under the --destpath, its first segment being the destination project, ignoring the source projects, or into the --destpath directory itself with a dir destination")
+	flag.Func("map", "Mapping of a source project to a destination project as src:dst, can be specified multiple times", collectFlagErrors("map", parseProjectMapping))
+	flag.BoolVar(&allProjects, "all-projects", false, "Migrate all the projects visible with the source credentials, the default when no --project is specified")
+	flag.Var(&projectsToExclude, "exclude-project", "Name of the project(s) not to migrate, taking precedence over --project")
+	flag.BoolVar(&verbose, "verbose", false, "Enable verbose logging, same as --log-level debug")
+	flag.StringVar(&output, "output", "table", "Format of the listing of the list command and of the summary of the migration per project, table or json, the json listing being a valid --from-file")
+	flag.BoolVar(&insecureSkipTLSVerify, "insecure-skip-tls-verify", false, "Skip TLS certificate verification of the source and destination Harbor")
+	flag.Var(&caCertFiles, "ca-cert", "Path of a PEM CA certificate bundle to trust, can be specified multiple times")
+	flag.StringVar(&clientCertFile, "client-cert", "", "Path of the PEM client certificate for mutual TLS authentication")
+	flag.StringVar(&clientKeyFile, "client-key", "", "Path of the PEM client key for mutual TLS authentication")
+	flag.Func("version-constraint", "SemVer constraint of the versions to migrate, e.g. \">=2.0.0 <3.0.0\"", collectFlagErrors("version-constraint", func(value string) error {
+		constraint, err := semver.NewConstraint(value)
+		versionConstraint = constraint
+		return err
+	}))
+	flag.BoolVar(&includeInvalidVersions, "include-invalid-versions", false, "Migrate the versions which are not valid SemVer when filtering with --version-constraint")
+	flag.Var(&nameFilters, "name-filter", "Glob pattern of the names of the Helm charts to migrate, can be specified multiple times")
+	flag.Var(&nameRegexps, "name-regex", "Regular expression of the names of the Helm charts to migrate, can be specified multiple times")
+	flag.Func("name-rewrite", "Rename of the Helm charts in the destination as regex=replacement, the matches of regex being replaced, e.g. ^=team- to add a prefix, can be specified multiple times to apply in order", collectFlagErrors("name-rewrite", parseNameRewrite))
+	flag.BoolVar(&caseSensitiveNames, "case-sensitive-names", false, "Match --name-filter and --name-regex case-sensitively")
+	flag.IntVar(&latestVersions, "latest", 0, "Number of highest versions of each Helm chart to migrate, 0 meaning all of them")
+	flag.BoolVar(&skipPrereleases, "skip-prereleases", false, "Do not migrate the SemVer prerelease versions, e.g. 1.0.0-rc1")
+	flag.IntVar(&limit, "limit", 0, "Maximum number of Helm charts to migrate, the first ones once filtered and sorted, 0 meaning no limit")
+	flag.StringVar(&chartsFile, "from-file", "", "Path of a file listing the Helm charts to migrate, as project/name/version lines or JSON, instead of listing the source ones")
+	flag.StringVar(&userAgent, "user-agent", "chartmuseum2oci/"+version, "User-Agent header of the requests to the source and destination Harbor, e.g. to identify the migration in their access logs")
+	flag.Func("header", "Header added to the requests to the source as \"Key: Value\", e.g. for a gateway in front of it, can be specified multiple times", collectFlagErrors("header", parseHeader))
+	flag.StringVar(&proxyURL, "proxy", "", "URL of the proxy to reach Harbor through, overriding the HTTP(S)_PROXY environment variables")
+	flag.StringVar(&logFormat, "log-format", "text", "Format of the logs, text or json")
+	flag.TextVar(&logLevel, "log-level", slog.LevelInfo, "Minimum level of the logs, debug, info, warn or error")
+	flag.StringVar(&logOutput, "log-output", "stdout", "Stream the logs are written to, stdout or stderr, the progress bar being written to the other one")
+	flag.BoolVar(&quiet, "quiet", false, "Only log warnings and errors, without progress bar")
+	flag.BoolVar(&showVersion, "version", false, "Print the version of the tool, the commit and Go version it was built with and the helm version, and exit")
+}
 
-	if sourceHarborURL == "" || destinationHarborURL == "" {
-		log.Fatal(errors.New("Missing required --source-url or --destination-url flag"))
-	}
+// initVerifyFlags registers the flags of the verify command.
+func initVerifyFlags() {
+	flag.IntVar(&concurrency, "concurrency", runtime.NumCPU(), "Number of Helm charts checked in parallel")
+	flag.BoolVar(&countCheck, "count-check", false, "Also compare the number of Helm chart versions of each destination project with the source one, logging a warning for each difference")
 }
 
-func main() {
-	if err := helmLogin(sourceHarborURL, sourceHarborUsername, sourceHarborPassword); err != nil {
-		log.Fatal(errors.Wrap(err, "Failed to login to source Harbor"))
-	}
+// initMigrateFlags registers the flags of the migrate command.
+func initMigrateFlags() {
+	flag.Func("image-rewrite", "Rewrite of the image registry prefix old to new in the values.yaml of the Helm charts and of their subcharts as old=new, can be specified multiple times", collectFlagErrors("image-rewrite", parseImageRewrite))
+	flag.Func("dependency-rewrite", "Rewrite of the repository URL old of the dependencies of the Helm charts to new, in their Chart.yaml and Chart.lock, as old=new, can be specified multiple times", collectFlagErrors("dependency-rewrite", parseDependencyRewrite))
+	flag.BoolVar(&rewriteDependencies, "rewrite-dependencies", false, "Rewrite the dependencies of the Helm charts on their source repository to their destination OCI repository")
+	flag.IntVar(&concurrency, "concurrency", runtime.NumCPU(), "Number of Helm charts migrated in parallel")
+	flag.IntVar(&perProjectConcurrency, "per-project-concurrency", 0, "Number of Helm charts of a same destination project migrated in parallel, within the --concurrency, 0 meaning no limit")
+	flag.DurationVar(&pullTimeout, "pull-timeout", migrate.DefaultPullTimeout, "Timeout of a Helm chart download from source, 0 means no timeout")
+	flag.DurationVar(&loginTimeout, "login-timeout", migrate.DefaultLoginTimeout, "Timeout of a helm registry login, 0 means no timeout")
+	flag.DurationVar(&chartTimeout, "chart-timeout", 0, "Maximum duration of the migration of a Helm chart, its retries included, after which it is cancelled and fails, e.g. 10m, 0 meaning no timeout")
+	flag.DurationVar(&deadline, "deadline", 0, "Maximum duration of the whole migration, e.g. 30m, after which no more Helm charts are scheduled and the in-flight ones are cancelled, 0 meaning no deadline")
+	flag.IntVar(&maxRetries, "max-retries", migrate.DefaultMaxRetries, "Maximum number of retries of a failed Helm chart pull or push")
+	flag.BoolVar(&overwrite, "overwrite", false, "Push Helm charts even if already present in destination")
+	flag.BoolVar(&listOnly, "list-only", false, "Print the Helm charts to migrate, after filtering, and exit without migrating them, same as the list command")
+	flag.BoolVar(&dryRun, "dry-run", false, "Log the actions of the migration without performing them")
+	flag.BoolVar(&createProjects, "create-projects", false, "Create the destination projects which do not exist")
+	flag.BoolVar(&requireDestProjects, "require-dest-projects", false, "Fail before migrating anything when a destination project of the Helm charts to migrate, once mapped, does not exist")
+	flag.BoolVar(&allowCollisions, "allow-collisions", false, "Migrate even when several Helm charts would be pushed to the same destination reference, e.g. once flattened or mapped, instead of failing before migrating anything")
+	flag.BoolVar(&createPublicProjects, "create-projects-public", false, "Make the projects created with --create-projects public")
+	flag.IntVar(&failThreshold, "fail-threshold", 0, "Number of Helm chart failures tolerated before the migration exits with a non-zero code")
+	flag.BoolVar(&failFast, "fail-fast", false, "Stop scheduling Helm charts as soon as one fails to migrate")
+	flag.IntVar(&maxConsecutiveFailures, "max-consecutive-failures", 0, "Number of Helm charts failing in a row aborting the migration, 0 meaning no limit")
+	flag.BoolVar(&skipVerifyDigest, "skip-verify-digest", false, "Do not verify the SHA256 of the downloaded Helm charts against their ChartMuseum digest")
+	flag.BoolVar(&validateCharts, "validate-chart", true, "Check the downloaded Helm charts are valid archives of the expected name and version")
+	flag.BoolVar(&verifyPush, "verify", false, "Pull every pushed Helm chart back from destination and verify its SHA256")
+	flag.BoolVar(&countCheck, "count-check", false, "Compare the number of Helm chart versions of each destination project with the source one once migrated, logging a warning for each difference")
+	flag.BoolVar(&shuffle, "shuffle", false, "Migrate the Helm charts in a random order instead of sorted by project, name and version, e.g. to spread the load")
+	flag.StringVar(&startFrom, "start-from", "", "Helm chart to start the migration from, as project/name/version, the ones before it in the migration order being skipped, e.g. to resume an interrupted run")
+	flag.StringVar(&checkpointFile, "checkpoint", "", "File recording the Helm charts migrated or already present in the destination, the ones it records being skipped when run again with it")
+	flag.BoolVar(&deleteSource, "delete-source", false, "Delete every Helm chart version from the source once migrated and verified, requires --verify and --confirm-delete")
+	flag.BoolVar(&confirmDelete, "confirm-delete", false, "Confirm the Helm charts are to be deleted from the source with --delete-source")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "Address the Prometheus metrics are served on at /metrics during the migration, e.g. :9090")
+	flag.StringVar(&pushgatewayURL, "pushgateway", "", "URL of a Prometheus Pushgateway the final metrics are pushed to once the migration ends, even when aborted")
+	flag.StringVar(&pushgatewayJob, "pushgateway-job", "chartmuseum2oci", "Job label of the metrics pushed to the --pushgateway")
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", "", "URL of an OpenTelemetry collector the traces of the migration are exported to with OTLP over HTTP, e.g. http://collector:4318")
+	flag.BoolVar(&emitEvents, "events", false, "Write the events of the migration to stdout as JSON lines instead of the progress bar and summary, the logs written to stdout being written to stderr")
+	flag.StringVar(&webhookURL, "webhook", "", "URL a JSON summary of the migration is POSTed to once it ends")
+	flag.StringVar(&webhookOn, "webhook-on", webhookOnAlways, "When the --webhook is notified, always or only on failure")
+	flag.StringVar(&reportFile, "report-file", "", "Path of the JSON report of the migration of every Helm chart")
+	flag.StringVar(&failuresFile, "failures-file", "", "Path of the file listing the Helm charts which failed to migrate, in the --from-file format")
+	flag.BoolVar(&keepCharts, "keep-charts", false, "Keep the downloaded Helm chart files")
+	flag.StringVar(&keepChartsDir, "keep-charts-dir", "", "Directory the Helm chart files are kept in, organized by project, implies --keep-charts")
+	flag.Var(&maxBandwidth, "max-bandwidth", "Maximum throughput of the downloads from the source, shared by all the workers, e.g. 10M/s, 0 meaning no limit")
+	flag.Var(&maxChartSize, "max-chart-size", "Size above which the Helm charts fail to migrate instead of being downloaded, e.g. 100M, 0 meaning no limit")
+	flag.Var(&minFreeSpace, "min-free-space", "Disk space which must remain free in the work directory, e.g. 1G, checked before the migration and each download")
+	flag.StringVar(&workDir, "work-dir", "", "Directory the Helm charts are downloaded into, defaults to a temporary directory removed on exit")
+	flag.StringVar(&pusher, "pusher", migrate.PusherHelm, "Way of pushing the Helm charts, helm to run helm push or oci to push them with an OCI client")
+	flag.BoolVar(&annotateMigration, "annotate-migration", false, "Annotate the manifest of the pushed Helm charts with their source URL and migration date, only supported with --pusher oci")
+	flag.StringVar(&helmBinaryPath, "helm-binary", "helm", "Path of the helm binary, looked up in the PATH when it is only a name")
+	flag.StringVar(&progressMode, "progress", progressAuto, "When the progress bar is rendered, auto to render it on a terminal and log progress lines otherwise, e.g. in CI, always or never")
+}
 
-	if err := helmLogin(destinationHarborURL, destinationHarborUsername, destinationHarborPassword); err != nil {
-		log.Fatal(errors.Wrap(err, "Failed to login to destination Harbor"))
+// parseFlags parses the flags of cmd in its command line arguments args, along
+// with the --config file and the credentials environment variables, and
+// validates the flags, logging all their errors.
+func parseFlags(cmd command, args []string) error {
+	initFlags(cmd)
+	if err := flag.CommandLine.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	if showVersion {
+		printVersion(os.Stdout)
+		return errVersionPrinted
+	}
+	switch cmd.name {
+	case commandList:
+		listOnly = true
+	case commandVerify:
+		// Nothing is pushed, the manifests being fetched with the OCI client.
+		verifyOnly, pusher = true, migrate.PusherOCI
 	}
 
-	helmChartsToMigrate, err := getHarborChartmuseumCharts()
-	if err != nil {
-		log.Fatal(errors.Wrap(err, "Failed to retrieve Helm charts from source"))
+	if err := setupLogger(); err != nil {
+		return err
 	}
 
-	log.Printf("%d Helm charts to migrate", len(helmChartsToMigrate))
-	bar := progressbar.Default(int64(len(helmChartsToMigrate)))
-	errorCount := 0
+	if configFile != "" {
+		if err := loadConfigFile(configFile); err != nil {
+			return errors.Wrapf(err, "Failed to load --config %s", configFile)
+		}
+		// The logging flags may be set by the file.
+		if err := setupLogger(); err != nil {
+			return err
+		}
+	}
+	loadCredentialsEnv()
 
-	for _, helmChart := range helmChartsToMigrate {
-		_ = bar.Add(1)
-		if err := migrateChartFromSourceToDestination(helmChart); err != nil {
-			errorCount++
-			log.Println(errors.Wrap(err, "Failed to migrate Helm chart"))
+	if errs := validateFlags(); len(errs) > 0 {
+		for _, err := range errs {
+			slog.Error(err.Error())
 		}
+		return errors.Errorf("Invalid flags, fix the %d errors above and run again", len(errs))
 	}
 
-	log.Printf("%d Helm charts successfully migrated", len(helmChartsToMigrate)-errorCount)
+	if insecureSkipTLSVerify {
+		slog.Warn("TLS certificate verification is disabled, connections to Harbor are not secure")
+	}
+	return nil
 }
 
-func helmLogin(registry, username, password string) error {
-	cmd := exec.Command(helmBinaryPath, "registry", "login", "--username", username, "--password", password, registry)
-	var stdErr bytes.Buffer
-	cmd.Stderr = &stdErr
+func parseProjectMapping(value string) error {
+	source, destination, found := strings.Cut(value, ":")
+	if !found || source == "" || destination == "" {
+		return errors.Errorf("invalid mapping %s, expected src:dst", value)
+	}
+	if _, ok := projectMapping[source]; ok {
+		return errors.Errorf("project %s is mapped more than once", source)
+	}
 
-	if err := cmd.Run(); err != nil {
-		return errors.Wrapf(err, "Failed to execute helm login: %s", stdErr.String())
+	projectMapping[source] = destination
+	return nil
+}
+
+func parseImageRewrite(value string) error {
+	prefix, replacement, found := strings.Cut(value, "=")
+	if !found || prefix == "" || replacement == "" {
+		return errors.Errorf("invalid image rewrite %s, expected old=new", value)
+	}
+	if _, ok := imageRewrites[prefix]; ok {
+		return errors.Errorf("image registry %s is rewritten more than once", prefix)
 	}
+
+	imageRewrites[prefix] = replacement
 	return nil
 }
 
-func migrateChartFromSourceToDestination(helmChart HelmChart) error {
-	if err := pullChartFromSource(helmChart); err != nil {
-		return errors.Wrap(err, "Failed to pull chart from source")
+func parseDependencyRewrite(value string) error {
+	repository, newRepository, found := strings.Cut(value, "=")
+	if !found || repository == "" || newRepository == "" {
+		return errors.Errorf("invalid dependency rewrite %s, expected old=new", value)
+	}
+	if _, ok := dependencyRewrites[repository]; ok {
+		return errors.Errorf("dependency repository %s is rewritten more than once", repository)
 	}
 
-	if err := pushChartToDestination(helmChart); err != nil {
-		return errors.Wrap(err, "Failed to push chart to destination")
+	dependencyRewrites[repository] = newRepository
+	return nil
+}
+
+// parseHeader parses a --header, whose values are added to the ones of the
+// same key.
+func parseHeader(value string) error {
+	key, headerValue, found := strings.Cut(value, ":")
+	key, headerValue = strings.TrimSpace(key), strings.TrimSpace(headerValue)
+	if !found || !httpguts.ValidHeaderFieldName(key) || !httpguts.ValidHeaderFieldValue(headerValue) {
+		return errors.Errorf("invalid header %q, expected \"Key: Value\"", value)
 	}
 
-	return removeChartFile(helmChart)
+	sourceHeaders.Add(key, headerValue)
+	return nil
 }
 
-func pullChartFromSource(helmChart HelmChart) error {
-	chartFileName := helmChart.ChartFileName()
-	sourceURL := fmt.Sprintf("%s/chartrepo/%s/charts/%s", sourceHarborURL, helmChart.Project, chartFileName)
+// parseNameRewrite parses a --name-rewrite, cut at its last = as the chart
+// names, and so the replacements, cannot have one.
+func parseNameRewrite(value string) error {
+	i := strings.LastIndex(value, "=")
+	if i <= 0 {
+		return errors.Errorf("invalid name rewrite %s, expected regex=replacement", value)
+	}
+	pattern, replacement := value[:i], value[i+1:]
+	if _, err := regexp.Compile(pattern); err != nil {
+		return errors.Wrapf(err, "invalid name rewrite regex %s", pattern)
+	}
 
-	req, err := http.NewRequest(http.MethodGet, sourceURL, nil)
+	nameRewrites = append(nameRewrites, migrate.NameRewrite{Pattern: pattern, Replacement: replacement})
+	return nil
+}
+
+func main() {
+	os.Exit(exitCode(run(os.Args[1:])))
+}
+
+// run runs the command of the command line arguments args, migrating or listing
+// the Helm charts as set by its flags, returning an exitError when it must exit
+// with another code than 1.
+func run(args []string) error {
+	cmd, args, err := parseCommand(args)
 	if err != nil {
-		return err
+		return &exitError{code: exitConfigError, err: err}
+	}
+	if cmd.name == commandVersion {
+		return runVersion(cmd, args)
 	}
-	req.SetBasicAuth(sourceHarborUsername, sourceHarborPassword)
 
-	client := &http.Client{Timeout: timeout}
-	res, err := client.Do(req)
-	if err != nil {
-		return err
+	if err := parseFlags(cmd, args); err != nil {
+		switch {
+		case errors.Is(err, flag.ErrHelp), errors.Is(err, errVersionPrinted):
+			return nil
+		case errors.Is(err, errUsage):
+			// The error was printed with the usage.
+			return &exitError{code: exitConfigError}
+		default:
+			return &exitError{code: exitConfigError, err: err}
+		}
+	}
+
+	slog.Info("Starting chartmuseum2oci", "command", cmd.name, "version", version, "commit", buildCommit(), "go", runtime.Version())
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		// A second signal kills the process right away.
+		<-ctx.Done()
+		stop()
+	}()
+
+	if deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, deadline, errDeadlineExceeded)
+		defer cancel()
+	}
+
+	var migrationProgress *progress
+	var migrationCheckpoint *checkpoint
+	chartMetrics := newMetrics()
+	if pushgatewayURL != "" && !listOnly {
+		// The metrics are pushed however the run ends, even before migrating.
+		defer func() {
+			if err := chartMetrics.push(pushgatewayURL, pushgatewayJob); err != nil {
+				slog.Error("Failed to push metrics", "pushgateway", pushgatewayURL, "error", err)
+			}
+		}()
+	}
+	opts := migrateOptions()
+	var events *eventStream
+	if emitEvents {
+		events = newEventStream(os.Stdout)
+	}
+	opts.OnStart = func(helmChart migrate.HelmChart) {
+		chartMetrics.chartStarted(helmChart)
+		if events != nil {
+			events.chartStarted(helmChart)
+		}
+	}
+	opts.OnResult = func(result migrate.ChartResult) {
+		chartMetrics.chartProcessed(result)
+		if events != nil {
+			events.chartDone(result)
+		}
+		migrationProgress.chartProcessed(result)
+		if migrationCheckpoint != nil {
+			if err := migrationCheckpoint.record(result); err != nil {
+				slog.Error("Failed to record Helm chart in checkpoint", "chart", result.Project+"/"+result.Name+"/"+result.Version, "error", err)
+			}
+		}
+	}
+	if metricsAddr != "" && !listOnly {
+		if err := chartMetrics.serve(metricsAddr); err != nil {
+			return errors.Wrap(err, "Failed to serve metrics")
+		}
 	}
-	defer res.Body.Close()
 
-	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("received status %d", res.StatusCode)
+	var tracerProvider *sdktrace.TracerProvider
+	if otlpEndpoint != "" && !listOnly {
+		var err error
+		if tracerProvider, err = newTracerProvider(otlpEndpoint); err != nil {
+			return errors.Wrap(err, "Failed to export traces")
+		}
+		opts.TracerProvider = tracerProvider
 	}
 
-	resBody, err := io.ReadAll(res.Body)
+	migrator, err := migrate.New(opts)
 	if err != nil {
-		return err
+		return &exitError{code: exitConfigError, err: errors.Wrap(err, "Failed to configure the migration")}
 	}
+	defer func() {
+		if err := migrator.Close(); err != nil {
+			slog.Error("Failed to clean up the migration", "error", err)
+		}
+	}()
 
-	return os.WriteFile(chartFileName, resBody, fileMode)
-}
+	if err := migrator.Connect(ctx); err != nil {
+		return errors.Wrap(err, "Failed to connect to Harbor")
+	}
+
+	var helmChartsToMigrate []migrate.HelmChart
+	if chartsFile != "" {
+		if helmChartsToMigrate, err = readChartsFile(chartsFile); err != nil {
+			return errors.Wrap(err, "Failed to read Helm charts file")
+		}
+	} else {
+		if helmChartsToMigrate, err = migrator.ListCharts(ctx); err != nil {
+			return errors.Wrap(err, "Failed to retrieve Helm charts from source")
+		}
+	}
+
+	// The counts are compared for all the listed Helm charts, whichever were
+	// migrated by this run.
+	listedCharts := helmChartsToMigrate
+
+	if shuffle {
+		rand.Shuffle(len(helmChartsToMigrate), func(i, j int) {
+			helmChartsToMigrate[i], helmChartsToMigrate[j] = helmChartsToMigrate[j], helmChartsToMigrate[i]
+		})
+	}
+
+	if startFrom != "" {
+		if helmChartsToMigrate, err = startFromChart(helmChartsToMigrate, startFrom); err != nil {
+			return &exitError{code: exitConfigError, err: errors.Wrap(err, "Invalid --start-from")}
+		}
+	}
+
+	if checkpointFile != "" {
+		completed, err := readCheckpoint(checkpointFile)
+		if err != nil {
+			return errors.Wrap(err, "Failed to read checkpoint")
+		}
+		helmChartsToMigrate = skipCompleted(helmChartsToMigrate, completed)
+	}
+
+	// limitedCount is the number of Helm charts before applying the --limit,
+	// 0 when not reached.
+	var limitedCount int
+	if limit > 0 && len(helmChartsToMigrate) > limit {
+		limitedCount = len(helmChartsToMigrate)
+		slog.Info("Limiting the migration to the first Helm charts", "limit", limit, "count", limitedCount)
+		helmChartsToMigrate = helmChartsToMigrate[:limit]
+	}
+
+	if listOnly {
+		if err := printCharts(os.Stdout, helmChartsToMigrate, output); err != nil {
+			return errors.Wrap(err, "Failed to print Helm charts")
+		}
+		return nil
+	}
 
-func pushChartToDestination(helmChart HelmChart) error {
-	repoURL := fmt.Sprintf("oci://%s/%s%s", destinationHarborURL, helmChart.Project, destPath)
-	cmd := exec.Command(helmBinaryPath, "push", helmChart.ChartFileName(), repoURL)
+	if verifyOnly {
+		return verifyDestinations(ctx, migrator, helmChartsToMigrate)
+	}
+
+	if collisions := migrator.Collisions(listedCharts); len(collisions) > 0 {
+		level := slog.LevelError
+		if allowCollisions {
+			level = slog.LevelWarn
+		}
+		for _, collision := range collisions {
+			sources := make([]string, 0, len(collision.HelmCharts))
+			for _, helmChart := range collision.HelmCharts {
+				sources = append(sources, helmChart.String())
+			}
+			slog.Log(ctx, level, "Helm charts would be pushed to the same destination reference, the destination only keeping one of them", "reference", collision.Reference, "sources", strings.Join(sources, ", "))
+		}
+		if !allowCollisions {
+			return &exitError{code: exitConfigError, err: errors.Errorf("%d destination references collide, fix the --map, --flatten or --name-rewrite or run with --allow-collisions", len(collisions))}
+		}
+	}
 
-	var stdErr bytes.Buffer
-	cmd.Stderr = &stdErr
+	if requireDestProjects {
+		if err := migrator.CheckDestinationProjects(ctx, helmChartsToMigrate); err != nil {
+			return &exitError{code: exitConfigError, err: err}
+		}
+	}
+
+	if checkpointFile != "" && !dryRun {
+		if migrationCheckpoint, err = openCheckpoint(checkpointFile); err != nil {
+			return errors.Wrap(err, "Failed to open checkpoint")
+		}
+	}
 
-	if err := cmd.Run(); err != nil {
-		return errors.Wrapf(err, "Failed to execute helm push: %s", stdErr.String())
+	slog.Info("Helm charts to migrate", "count", len(helmChartsToMigrate))
+	migrationProgress = newProgress(newProgressBar(len(helmChartsToMigrate)), len(helmChartsToMigrate), logProgressLines())
+	if events != nil {
+		events.runStarted(len(helmChartsToMigrate))
+	}
+	start := time.Now()
+	summary, migrateErr := migrator.Migrate(ctx, helmChartsToMigrate)
+	totals := newRunTotals(len(helmChartsToMigrate), summary.Results, time.Since(start), runError(ctx, summary, migrateErr))
+	if events != nil {
+		events.runEnded(totals)
+	}
+
+	if webhookURL != "" {
+		payload := newWebhookPayload(totals, summary.Results)
+		if webhookOn == webhookOnAlways || payload.failed() {
+			if err := notifyWebhook(webhookURL, payload); err != nil {
+				slog.Error("Failed to notify webhook", "error", err)
+			}
+		}
+	}
+	if migrationCheckpoint != nil {
+		if err := migrationCheckpoint.Close(); err != nil {
+			slog.Error("Failed to write checkpoint", "error", err)
+		}
+	}
+	if countCheck && !dryRun && ctx.Err() == nil {
+		if err := checkCounts(ctx, migrator, listedCharts); err != nil {
+			slog.Error(err.Error())
+		}
+	}
+	if tracerProvider != nil {
+		if err := shutdownTracerProvider(tracerProvider); err != nil {
+			slog.Error("Failed to export traces", "endpoint", otlpEndpoint, "error", err)
+		}
+	}
+
+	slog.Info("Helm charts successfully migrated", "count", summary.Processed-summary.Failed)
+	if limitedCount > 0 {
+		slog.Info("Migration was limited", "limit", limit, "notMigrated", limitedCount-limit)
+	}
+	if reportFile != "" {
+		if err := writeReport(reportFile, summary.Results); err != nil {
+			slog.Error("Failed to write report", "error", err)
+		}
+	}
+	if failuresFile != "" {
+		if err := writeFailuresFile(failuresFile, summary.Results); err != nil {
+			slog.Error("Failed to write failures file", "error", err)
+		}
+	}
+	if events == nil {
+		if err := printSummary(os.Stdout, summary.Results, output); err != nil {
+			slog.Error("Failed to print summary", "error", err)
+		}
+	}
+
+	if migrateErr != nil {
+		return errors.Wrap(migrateErr, "Failed to migrate Helm charts")
+	}
+
+	if errors.Is(context.Cause(ctx), errDeadlineExceeded) {
+		slog.Error("Migration stopped by deadline", "deadline", deadline, "failed", summary.Failed, "notProcessed", len(helmChartsToMigrate)-summary.Processed)
+		return &exitError{code: exitDeadlineExceeded}
+	}
+
+	if ctx.Err() != nil {
+		slog.Warn("Migration interrupted", "failed", summary.Failed, "notProcessed", len(helmChartsToMigrate)-summary.Processed)
+		return &exitError{code: 1}
+	}
+
+	if summary.AbortCause != nil {
+		slog.Error("Migration aborted", "reason", summary.AbortCause, "notProcessed", len(helmChartsToMigrate)-summary.Processed)
+	}
+
+	if summary.Failed > failThreshold || summary.AbortCause != nil {
+		slog.Error("Migration failed", "failed", summary.Failed, "failThreshold", failThreshold)
+		if summary.Failed == summary.Processed {
+			return &exitError{code: exitAllChartsFailed}
+		}
+		return &exitError{code: exitSomeChartsFailed}
 	}
 	return nil
 }
 
-func removeChartFile(helmChart HelmChart) error {
-	return os.Remove(helmChart.ChartFileName())
+// migrateOptions returns the options of the migration set by the flags.
+func migrateOptions() migrate.Options {
+	// --all-projects is the same as no --project.
+	projects := []string(projectsToMigrate)
+	if allProjects {
+		projects = nil
+	}
+
+	var destination migrate.HarborOptions
+	var mirrors []migrate.HarborOptions
+	if len(destinations) > 0 {
+		destination, mirrors = destinations[0], destinations[1:]
+	}
+
+	return migrate.Options{
+		SourceType:             sourceType,
+		SourceAPI:              sourceAPI,
+		SourceURL:              sourceHarborURL,
+		DestinationType:        destinationType,
+		SourceUsername:         sourceHarborUsername,
+		SourcePassword:         sourceHarborPassword,
+		SourceToken:            sourceToken,
+		SourceTokenRefresher:   sourceTokenRefresher(),
+		DestinationURL:         destination.URL,
+		DestinationUsername:    destination.Username,
+		DestinationPassword:    destination.Password,
+		DestinationToken:       destination.Token,
+		Mirrors:                mirrors,
+		DestPath:               destPath,
+		Projects:               projects,
+		ExcludeProjects:        projectsToExclude,
+		ProjectMapping:         projectMapping,
+		Flatten:                flatten,
+		ImageRewrites:          imageRewrites,
+		DependencyRewrites:     dependencyRewrites,
+		RewriteDependencies:    rewriteDependencies,
+		Concurrency:            concurrency,
+		PerProjectConcurrency:  perProjectConcurrency,
+		PullTimeout:            pullTimeout,
+		ChartTimeout:           chartTimeout,
+		LoginTimeout:           loginTimeout,
+		MaxRetries:             maxRetries,
+		Overwrite:              overwrite,
+		DryRun:                 dryRun,
+		InsecureSkipTLSVerify:  insecureSkipTLSVerify,
+		CACertFiles:            caCertFiles,
+		ClientCertFile:         clientCertFile,
+		ClientKeyFile:          clientKeyFile,
+		ProxyURL:               proxyURL,
+		UserAgent:              userAgent,
+		SourceHeaders:          sourceHeaders,
+		WorkDir:                workDir,
+		KeepCharts:             keepCharts,
+		MinFreeSpace:           int64(minFreeSpace),
+		MaxChartSize:           int64(maxChartSize),
+		MaxBandwidth:           int64(maxBandwidth),
+		CreateProjects:         createProjects,
+		CreatePublicProjects:   createPublicProjects,
+		VersionConstraint:      versionConstraint,
+		IncludeInvalidVersions: includeInvalidVersions,
+		NameFilters:            nameFilters,
+		NameRegexps:            nameRegexps,
+		NameRewrites:           nameRewrites,
+		CaseSensitiveNames:     caseSensitiveNames,
+		LatestVersions:         latestVersions,
+		SkipPrereleases:        skipPrereleases,
+		FailFast:               failFast,
+		MaxConsecutiveFailures: maxConsecutiveFailures,
+		SkipVerifyDigest:       skipVerifyDigest,
+		ValidateCharts:         validateCharts,
+		Verify:                 verifyPush,
+		DeleteSource:           deleteSource && !listOnly,
+		Pusher:                 pusher,
+		AnnotateMigration:      annotateMigration,
+		HelmBinaryPath:         helmBinaryPath,
+		ListOnly:               listOnly,
+		Logger:                 slog.Default(),
+	}
+}
+
+// newProgressBar returns the progress bar of the migration of count Helm charts,
+// written to progressOutput when showProgressBar.
+func newProgressBar(count int) *progressbar.ProgressBar {
+	if !showProgressBar() {
+		return progressbar.DefaultSilent(int64(count))
+	}
+
+	output := progressOutput()
+	return progressbar.NewOptions(count,
+		progressbar.OptionSetWriter(output),
+		progressbar.OptionSetWidth(10),
+		progressbar.OptionThrottle(65*time.Millisecond),
+		progressbar.OptionShowCount(),
+		progressbar.OptionOnCompletion(func() {
+			fmt.Fprint(output, "\n")
+		}),
+		progressbar.OptionSpinnerType(14),
+		progressbar.OptionFullWidth(),
+		progressbar.OptionSetRenderBlankState(true),
+	)
+}
+
+// reportEntry is an entry of the --report-file, the result of a Helm chart
+// along with the build of the tool which migrated it, the report remaining a
+// valid --from-file.
+type reportEntry struct {
+	migrate.ChartResult
+	ToolVersion string `json:"toolVersion"`
+	Commit      string `json:"commit"`
+}
+
+func writeReport(reportPath string, results []migrate.ChartResult) error {
+	entries := make([]reportEntry, 0, len(results))
+	for _, result := range results {
+		entries = append(entries, reportEntry{ChartResult: result, ToolVersion: version, Commit: buildCommit()})
+	}
+
+	content, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(reportPath, content, fileMode)
 }
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pacha5065/chartmuseum-migration-tools/chartmuseum2oci/pkg/migrate"
+)
+
+func TestWriteReport(t *testing.T) {
+	reportPath := filepath.Join(t.TempDir(), "report.json")
+	results := []migrate.ChartResult{{Project: "library", Name: "mychart", Version: "1.0.0", Status: migrate.StatusMigrated}}
+	if err := writeReport(reportPath, results); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(reportPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []map[string]any
+	if err := json.Unmarshal(content, &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0]["version"] != "1.0.0" || entries[0]["toolVersion"] != version || entries[0]["commit"] != buildCommit() {
+		t.Errorf("report is %s, want the chart with the version %s and commit %s of the tool", content, version, buildCommit())
+	}
+
+	// The report is a valid --from-file.
+	helmCharts, err := readChartsFile(reportPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(helmCharts) != 1 || helmCharts[0].Key() != "library/mychart/1.0.0" {
+		t.Errorf("report lists Helm charts %v, want library/mychart/1.0.0", helmCharts)
+	}
+}
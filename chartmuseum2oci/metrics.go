@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/pacha5065/chartmuseum-migration-tools/chartmuseum2oci/pkg/migrate"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+const (
+	metricsNamespace = "chartmuseum2oci"
+	pushTimeout      = 30 * time.Second
+)
+
+// metrics are the Prometheus metrics of the migration, the ones of the Go
+// runtime and of the process only being served, not pushed.
+type metrics struct {
+	registry      *prometheus.Registry
+	start         time.Time
+	charts        *prometheus.CounterVec
+	chartDuration prometheus.Histogram
+	inFlight      prometheus.Gauge
+	bytes         prometheus.Counter
+	runDuration   prometheus.GaugeFunc
+	buildInfo     *prometheus.GaugeVec
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		start:    time.Now(),
+		charts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "charts_total",
+			Help:      "Number of processed Helm charts, by status.",
+		}, []string{"status"}),
+		chartDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "chart_duration_seconds",
+			Help:      "Duration of the migration of a Helm chart.",
+			Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12),
+		}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "in_flight_charts",
+			Help:      "Number of Helm charts being migrated by the workers.",
+		}),
+		bytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "bytes_total",
+			Help:      "Size of the downloaded Helm charts.",
+		}),
+	}
+	m.runDuration = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "run_duration_seconds",
+		Help:      "Duration of the migration so far.",
+	}, func() float64 {
+		return time.Since(m.start).Seconds()
+	})
+
+	m.buildInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "build_info",
+		Help:      "Build of the tool running the migration, always 1.",
+	}, []string{"version", "commit", "goversion"})
+	m.buildInfo.WithLabelValues(version, buildCommit(), runtime.Version()).Set(1)
+
+	// The statuses are exported from the start, as zeros.
+	for _, status := range []migrate.ChartStatus{migrate.StatusMigrated, migrate.StatusSkipped, migrate.StatusFailed} {
+		m.charts.WithLabelValues(string(status))
+	}
+
+	m.registry.MustRegister(m.charts, m.chartDuration, m.inFlight, m.bytes, m.runDuration, m.buildInfo)
+	return m
+}
+
+func (m *metrics) chartStarted(migrate.HelmChart) {
+	m.inFlight.Inc()
+}
+
+func (m *metrics) chartProcessed(result migrate.ChartResult) {
+	m.inFlight.Dec()
+	m.charts.WithLabelValues(string(result.Status)).Inc()
+	m.chartDuration.Observe((time.Duration(result.DurationMs) * time.Millisecond).Seconds())
+	m.bytes.Add(float64(result.Bytes))
+}
+
+// serve serves the metrics on /metrics at addr in the background, failing
+// right away when addr cannot be listened on.
+func (m *metrics) serve(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	runtimeRegistry := prometheus.NewRegistry()
+	runtimeRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(prometheus.Gatherers{m.registry, runtimeRegistry}, promhttp.HandlerOpts{}))
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			slog.Error("Failed to serve metrics", "error", err)
+		}
+	}()
+
+	slog.Info("Serving metrics", "url", "http://"+listener.Addr().String()+"/metrics")
+	return nil
+}
+
+// push pushes the metrics to the Pushgateway at pushgatewayURL under job,
+// replacing the ones of its previous run.
+func (m *metrics) push(pushgatewayURL, job string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), pushTimeout)
+	defer cancel()
+
+	return push.New(pushgatewayURL, job).Gatherer(m.registry).PushContext(ctx)
+}
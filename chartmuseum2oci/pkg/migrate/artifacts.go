@@ -0,0 +1,257 @@
+package migrate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/goharbor/go-client/pkg/sdk/v2.0/client"
+	"github.com/goharbor/go-client/pkg/sdk/v2.0/client/artifact"
+	"github.com/goharbor/go-client/pkg/sdk/v2.0/client/repository"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/registry/remote"
+	"oras.land/oras-go/v2/registry/remote/auth"
+	"oras.land/oras-go/v2/registry/remote/errcode"
+)
+
+// Values of Options.SourceAPI.
+const (
+	SourceAPIChartRepo = "v1"
+	SourceAPIArtifacts = "v2"
+)
+
+// chartArtifactType is the type Harbor gives to the Helm chart artifacts.
+const chartArtifactType = "CHART"
+
+// harborArtifactSource is the OCI registry of a Harbor, its Helm charts being
+// the chart artifacts of the repositories of its projects, listed with the v2.0
+// API instead of the ChartMuseum one, e.g. once ChartMuseum is disabled.
+type harborArtifactSource struct {
+	harborURL string
+	registry  string
+	*sourceCredentials
+	projects        []string
+	excludeProjects []string
+	apiClient       *harborClient
+	projectList     *projectList
+	httpClient      *http.Client
+	authCache       auth.Cache
+}
+
+func (s *harborArtifactSource) Check(ctx context.Context) error {
+	return checkHarbor(ctx, s.apiClient.v2)
+}
+
+func (s *harborArtifactSource) ListCharts(ctx context.Context) ([]HelmChart, error) {
+	projects, err := projectsToMigrate(ctx, s.projectList, s.projects, s.excludeProjects)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to list projects")
+	}
+
+	helmCharts := make([]HelmChart, 0)
+	for _, projectName := range projects {
+		projectCharts, err := s.getProjectArtifactCharts(ctx, projectName)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to list Helm charts of project %s", projectName)
+		}
+		helmCharts = append(helmCharts, projectCharts...)
+	}
+
+	return helmCharts, nil
+}
+
+// getProjectArtifactCharts returns the Helm charts of the chart artifacts of the
+// repositories at the root of the project, a version per tag.
+func (s *harborArtifactSource) getProjectArtifactCharts(ctx context.Context, projectName string) ([]HelmChart, error) {
+	helmCharts := make([]HelmChart, 0)
+	pageSize := int64(defaultPageSize)
+	var listedCount int
+	for page := int64(1); ; page++ {
+		pageCtx, cancel := contextWithTimeout(ctx, apiTimeout)
+		res, err := s.apiClient.v2.Repository.ListRepositories(pageCtx, repository.NewListRepositoriesParams().WithProjectName(projectName).WithPage(&page).WithPageSize(&pageSize))
+		cancel()
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to list repositories page %d", page)
+		}
+
+		for _, repo := range res.Payload {
+			chartName := strings.TrimPrefix(repo.Name, projectName+"/")
+			if strings.Contains(chartName, "/") {
+				// The chart name is the last path segment of the repository,
+				// which could not be pulled back from it.
+				continue
+			}
+			repoCharts, err := s.getRepositoryCharts(ctx, projectName, chartName)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Failed to list artifacts of repository %s", repo.Name)
+			}
+			helmCharts = append(helmCharts, repoCharts...)
+		}
+
+		listedCount += len(res.Payload)
+		if isLastPage(len(res.Payload), listedCount, res.XTotalCount) {
+			return helmCharts, nil
+		}
+	}
+}
+
+// getRepositoryCharts returns the Helm charts of the chart artifacts of the
+// repository chartName, their version being the one of their Chart.yaml kept
+// by Harbor, or else their tag.
+func (s *harborArtifactSource) getRepositoryCharts(ctx context.Context, projectName, chartName string) ([]HelmChart, error) {
+	return listRepositoryCharts(ctx, s.apiClient.v2, projectName, chartName)
+}
+
+// listRepositoryCharts returns the Helm charts of the chart artifacts of the
+// repository repositoryName of the project projectName, a version per tag.
+func listRepositoryCharts(ctx context.Context, apiClient *client.HarborAPI, projectName, repositoryName string) ([]HelmChart, error) {
+	helmCharts := make([]HelmChart, 0)
+	pageSize := int64(defaultPageSize)
+	withTag := true
+	query := "type=" + chartArtifactType
+	var listedCount int
+	for page := int64(1); ; page++ {
+		params := artifact.NewListArtifactsParams().
+			WithProjectName(projectName).
+			WithRepositoryName(url.PathEscape(repositoryName)).
+			WithQ(&query).
+			WithWithTag(&withTag).
+			WithPage(&page).
+			WithPageSize(&pageSize)
+		pageCtx, cancel := contextWithTimeout(ctx, apiTimeout)
+		res, err := apiClient.Artifact.ListArtifacts(pageCtx, params)
+		cancel()
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to list artifacts page %d", page)
+		}
+
+		for _, chartArtifact := range res.Payload {
+			if chartArtifact.Type != chartArtifactType {
+				continue
+			}
+			version, _ := chartArtifact.ExtraAttrs["version"].(string)
+			for _, tag := range chartArtifact.Tags {
+				helmChart := HelmChart{Name: repositoryName, Project: projectName, Version: version}
+				if helmChart.Version == "" || helmChart.Tag() != tag.Name {
+					helmChart.Version = tag.Name
+				}
+				helmCharts = append(helmCharts, helmChart)
+			}
+		}
+
+		listedCount += len(res.Payload)
+		if isLastPage(len(res.Payload), listedCount, res.XTotalCount) {
+			return helmCharts, nil
+		}
+	}
+}
+
+func (s *harborArtifactSource) PullChart(ctx context.Context, helmChart HelmChart) (io.ReadCloser, error) {
+	return s.fetchLayer(ctx, helmChart, helmChartMediaType)
+}
+
+func (s *harborArtifactSource) PullProvenance(ctx context.Context, helmChart HelmChart) (io.ReadCloser, error) {
+	return s.fetchLayer(ctx, helmChart, helmProvenanceMediaType)
+}
+
+func (s *harborArtifactSource) ChartURL(helmChart HelmChart) string {
+	return fmt.Sprintf("oci://%s/%s/%s:%s", s.registry, helmChart.Project, helmChart.Name, helmChart.Tag())
+}
+
+// fetchLayer opens the layer of mediaType of the manifest of helmChart,
+// returning ErrNotFound when it has none.
+func (s *harborArtifactSource) fetchLayer(ctx context.Context, helmChart HelmChart, mediaType string) (io.ReadCloser, error) {
+	repo, err := s.newOCIRepository(helmChart)
+	if err != nil {
+		return nil, err
+	}
+
+	manifestDescriptor, manifestContent, err := oras.FetchBytes(ctx, repo, helmChart.Tag(), oras.DefaultFetchBytesOptions)
+	if err != nil {
+		return nil, classifySourceOCIError(errors.Wrap(err, "Failed to fetch chart manifest"))
+	}
+	if manifestDescriptor.MediaType != ocispec.MediaTypeImageManifest {
+		return nil, errors.Errorf("unexpected chart manifest media type %s", manifestDescriptor.MediaType)
+	}
+
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(manifestContent, &manifest); err != nil {
+		return nil, errors.Wrap(err, "Failed to parse chart manifest")
+	}
+	for _, layer := range manifest.Layers {
+		if layer.MediaType != mediaType {
+			continue
+		}
+		blob, err := repo.Blobs().Fetch(ctx, layer)
+		if err != nil {
+			return nil, classifySourceOCIError(errors.Wrap(err, "Failed to fetch chart layer"))
+		}
+		return &layerContent{ReadCloser: blob, verifier: content.NewVerifyReader(blob, layer), size: layer.Size}, nil
+	}
+	return nil, ErrNotFound
+}
+
+// newOCIRepository returns the client of the source repository of helmChart,
+// authenticated with the source credentials.
+func (s *harborArtifactSource) newOCIRepository(helmChart HelmChart) (*remote.Repository, error) {
+	repo, err := remote.NewRepository(s.registry + "/" + helmChart.Project + "/" + helmChart.Name)
+	if err != nil {
+		return nil, err
+	}
+	repo.PlainHTTP = strings.HasPrefix(s.harborURL, "http://")
+	repo.Client = &auth.Client{
+		Client: s.httpClient,
+		Credential: func(context.Context, string) (auth.Credential, error) {
+			s.mutex.RLock()
+			defer s.mutex.RUnlock()
+			return auth.Credential{Username: s.username, Password: s.password, AccessToken: s.token}, nil
+		},
+		Cache: s.authCache,
+	}
+	return repo, nil
+}
+
+// layerContent is a layer blob read through the verifier of its digest, along
+// with its size.
+type layerContent struct {
+	io.ReadCloser
+	verifier *content.VerifyReader
+	size     int64
+}
+
+func (c *layerContent) Read(p []byte) (int, error) {
+	n, err := c.verifier.Read(p)
+	if err == io.EOF {
+		if verifyErr := c.verifier.Verify(); verifyErr != nil {
+			return n, verifyErr
+		}
+	}
+	return n, err
+}
+
+func (c *layerContent) Size() int64 {
+	return c.size
+}
+
+// classifySourceOCIError returns ErrInvalidCredentials when the source rejects
+// the credentials, ErrNotFound when it does not have the chart, and marks the
+// errors of a transient failure as retryable.
+func classifySourceOCIError(err error) error {
+	var errorResponse *errcode.ErrorResponse
+	if errors.As(err, &errorResponse) {
+		switch errorResponse.StatusCode {
+		case http.StatusUnauthorized:
+			return ErrInvalidCredentials
+		case http.StatusNotFound:
+			return errors.Wrap(ErrNotFound, err.Error())
+		}
+	}
+	return classifyOCIError(err)
+}
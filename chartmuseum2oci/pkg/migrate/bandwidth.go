@@ -0,0 +1,82 @@
+package migrate
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// bandwidthChunks is the number of reads a second of the MaxBandwidth is split
+// into at most, to keep the throughput steady.
+const bandwidthChunks = 10
+
+// bandwidthLimiter limits the aggregate throughput of the downloads of all the
+// workers to bytesPerSecond, each read reserving its transfer time after the
+// ones of the previous reads.
+type bandwidthLimiter struct {
+	bytesPerSecond int64
+
+	mutex sync.Mutex
+	// next is when the transfer time reserved by the previous reads ends.
+	next time.Time
+}
+
+func newBandwidthLimiter(bytesPerSecond int64) *bandwidthLimiter {
+	return &bandwidthLimiter{bytesPerSecond: bytesPerSecond}
+}
+
+// wait reserves the transfer time of n bytes, waiting for the end of the ones
+// reserved before unless ctx is done first.
+func (l *bandwidthLimiter) wait(ctx context.Context, n int) error {
+	l.mutex.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		// The unused bandwidth is not saved for later bursts.
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.bytesPerSecond))
+	l.mutex.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// reader returns reader throttled by the bandwidth limiter.
+func (l *bandwidthLimiter) reader(ctx context.Context, reader io.Reader) io.Reader {
+	maxRead := l.bytesPerSecond / bandwidthChunks
+	if maxRead < 1 {
+		maxRead = 1
+	}
+	return &throttledReader{ctx: ctx, reader: reader, limiter: l, maxRead: int(maxRead)}
+}
+
+type throttledReader struct {
+	ctx     context.Context
+	reader  io.Reader
+	limiter *bandwidthLimiter
+	maxRead int
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > r.maxRead {
+		p = p[:r.maxRead]
+	}
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		if waitErr := r.limiter.wait(r.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,316 @@
+package migrate
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	chartMetadataFileName = "Chart.yaml"
+	yamlIndent            = 2
+	maxTagLength          = 128
+	provenanceFileSuffix  = ".prov"
+	partFileSuffix        = ".part"
+)
+
+var ociTagRegexp = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]*$`)
+
+type HelmChart struct {
+	Name    string
+	Project string
+	Version string
+	// Digest is the SHA256 of the chart file listed by ChartMuseum, if any.
+	Digest string
+	// NewName is the name of the chart in the destination as rewritten by the
+	// Options.NameRewrites, the Name when empty.
+	NewName string
+}
+
+func (hc HelmChart) ChartFileName() string {
+	return fmt.Sprintf("%s-%s.tgz", hc.Name, hc.Version)
+}
+
+// Key returns the chart as project/name/version, as parsed by ParseChartKey.
+func (hc HelmChart) Key() string {
+	return hc.Project + "/" + hc.Name + "/" + hc.Version
+}
+
+func (hc HelmChart) String() string {
+	return fmt.Sprintf("%s/%s:%s", hc.Project, hc.Name, hc.Version)
+}
+
+// DestinationName returns the name of the chart in the destination, its
+// NewName if any, OCI repository names having to be lowercase.
+func (hc HelmChart) DestinationName() string {
+	if hc.NewName != "" {
+		return strings.ToLower(hc.NewName)
+	}
+	return strings.ToLower(hc.Name)
+}
+
+// Tag returns the OCI tag of the chart version, '+' being invalid in tags and
+// replaced by '_' as helm push does.
+func (hc HelmChart) Tag() string {
+	return strings.ReplaceAll(hc.Version, "+", "_")
+}
+
+// SortCharts sorts Helm charts by project, name and version, the versions by
+// SemVer precedence.
+func SortCharts(helmCharts []HelmChart) {
+	sort.SliceStable(helmCharts, func(i, j int) bool {
+		a, b := helmCharts[i], helmCharts[j]
+		if a.Project != b.Project {
+			return a.Project < b.Project
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return compareVersions(a.Version, b.Version) < 0
+	})
+}
+
+// ParseChartKey parses a Helm chart given as project/name/version, the project
+// being everything before the last two segments, e.g. org/team for the nested
+// repositories of a ChartMuseum with multitenancy.
+func ParseChartKey(key string) (HelmChart, error) {
+	parts := strings.Split(key, "/")
+	if len(parts) < 3 || slices.Contains(parts, "") {
+		return HelmChart{}, errors.Errorf("invalid Helm chart %s, expected project/name/version", key)
+	}
+	return HelmChart{
+		Project: strings.Join(parts[:len(parts)-2], "/"),
+		Name:    parts[len(parts)-2],
+		Version: parts[len(parts)-1],
+	}, nil
+}
+
+func validateTag(tag string) error {
+	if len(tag) > maxTagLength {
+		return errors.Errorf("OCI tag %s is longer than %d characters", tag, maxTagLength)
+	}
+	if !ociTagRegexp.MatchString(tag) {
+		return errors.Errorf("%s is not a valid OCI tag", tag)
+	}
+	return nil
+}
+
+// chartFileTransform returns the new content of the file name of a chart archive.
+type chartFileTransform func(name string, content []byte) ([]byte, error)
+
+// isChartMetadataFile tells whether name is the Chart.yaml of the chart
+// itself within its archive, and not the one of a subchart.
+func isChartMetadataFile(name string) bool {
+	return isChartFile(name, chartMetadataFileName)
+}
+
+// isChartFile tells whether name is the file fileName at the root of the chart
+// itself within its archive.
+func isChartFile(name, fileName string) bool {
+	dir, file, found := strings.Cut(name, "/")
+	return found && dir != "" && file == fileName
+}
+
+// repackChart rewrites the Helm chart archive at chartFilePath with the content of
+// its files replaced by the one returned by transform.
+func repackChart(chartFilePath string, transform chartFileTransform) error {
+	tmpFileName := chartFilePath + ".repack"
+	if err := writeRepackedChart(chartFilePath, tmpFileName, transform); err != nil {
+		os.Remove(tmpFileName)
+		return errors.Wrap(err, "Failed to repack chart")
+	}
+
+	return os.Rename(tmpFileName, chartFilePath)
+}
+
+func writeRepackedChart(chartFilePath, repackedFilePath string, transform chartFileTransform) error {
+	src, err := os.Open(chartFilePath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(repackedFilePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fileMode)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	if err := repackArchive(src, dst, transform); err != nil {
+		return err
+	}
+	return dst.Close()
+}
+
+// repackArchive writes to dst the gzipped tar archive read from src with the
+// content of its files replaced by the one returned by transform.
+func repackArchive(src io.Reader, dst io.Writer, transform chartFileTransform) error {
+	gzipReader, err := gzip.NewReader(src)
+	if err != nil {
+		return err
+	}
+	tarReader := tar.NewReader(gzipReader)
+
+	gzipWriter := gzip.NewWriter(dst)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	for {
+		header, err := tarReader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		content, err := io.ReadAll(tarReader)
+		if err != nil {
+			return err
+		}
+
+		if header.Typeflag == tar.TypeReg {
+			if content, err = transform(header.Name, content); err != nil {
+				return errors.Wrapf(err, "Failed to transform %s", header.Name)
+			}
+			header.Size = int64(len(content))
+		}
+
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := tarWriter.Write(content); err != nil {
+			return err
+		}
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return err
+	}
+	return gzipWriter.Close()
+}
+
+// setChartMetadataField sets the top level key of a Chart.yaml content to value,
+// keeping the other fields and their comments as they are.
+func setChartMetadataField(chartMetadata []byte, key, value string) ([]byte, error) {
+	var document yaml.Node
+	if err := yaml.Unmarshal(chartMetadata, &document); err != nil {
+		return nil, err
+	}
+
+	if len(document.Content) == 0 || document.Content[0].Kind != yaml.MappingNode {
+		return nil, errors.New("Chart.yaml is not a mapping")
+	}
+
+	fields := document.Content[0]
+	found := false
+	for i := 0; i+1 < len(fields.Content); i += 2 {
+		if fields.Content[i].Value == key {
+			fields.Content[i+1].SetString(value)
+			found = true
+		}
+	}
+	if !found {
+		return nil, errors.Errorf("Chart.yaml has no %s field", key)
+	}
+
+	return encodeYAML(&document)
+}
+
+// encodeYAML encodes document with the indentation of Helm charts.
+func encodeYAML(document *yaml.Node) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(yamlIndent)
+	if err := encoder.Encode(document); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// readChartMetadata returns the Chart.yaml content of the Helm chart archive at
+// chartFilePath, reading the whole archive to check it is a valid one.
+func readChartMetadata(chartFilePath string) ([]byte, error) {
+	file, err := os.Open(chartFilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	gzipReader, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "chart file is not gzipped")
+	}
+	tarReader := tar.NewReader(gzipReader)
+
+	var chartMetadata []byte
+	for {
+		header, err := tarReader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "chart file is not a valid tar archive")
+		}
+
+		content, err := io.ReadAll(tarReader)
+		if err != nil {
+			return nil, errors.Wrap(err, "chart file is not a valid tar archive")
+		}
+
+		if header.Typeflag == tar.TypeReg && isChartMetadataFile(header.Name) {
+			chartMetadata = content
+		}
+	}
+
+	if chartMetadata == nil {
+		return nil, errors.Errorf("chart file has no %s", chartMetadataFileName)
+	}
+	return chartMetadata, nil
+}
+
+// validateChart checks the file at chartFilePath is a gzipped tar archive of
+// the Helm chart with the name and version of helmChart. The names are compared
+// case-insensitively, the ones of the Helm charts listed from the chart
+// artifacts of a Harbor being the lowercase names of their OCI repository.
+func validateChart(chartFilePath string, helmChart HelmChart) error {
+	chartMetadata, err := readChartMetadata(chartFilePath)
+	if err != nil {
+		return err
+	}
+
+	var metadata struct {
+		Name    string `yaml:"name"`
+		Version string `yaml:"version"`
+	}
+	if err := yaml.Unmarshal(chartMetadata, &metadata); err != nil {
+		return errors.Wrapf(err, "invalid %s", chartMetadataFileName)
+	}
+
+	if !strings.EqualFold(metadata.Name, helmChart.Name) || metadata.Version != helmChart.Version {
+		return errors.Errorf("chart file is %s %s instead of %s %s", metadata.Name, metadata.Version, helmChart.Name, helmChart.Version)
+	}
+	return nil
+}
+
+// renameChart rewrites the name of the Helm chart archive at chartFilePath.
+func renameChart(chartFilePath, name string) error {
+	return repackChart(chartFilePath, func(fileName string, content []byte) ([]byte, error) {
+		if !isChartMetadataFile(fileName) {
+			return content, nil
+		}
+		return setChartMetadataField(content, "name", name)
+	})
+}
@@ -0,0 +1,117 @@
+package migrate
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTag(t *testing.T) {
+	for _, test := range []struct {
+		version string
+		wantTag string
+		wantErr bool
+	}{
+		{version: "1.2.3", wantTag: "1.2.3"},
+		{version: "1.2.3-rc.1", wantTag: "1.2.3-rc.1"},
+		{version: "1.2.3+build5", wantTag: "1.2.3_build5"},
+		{version: "1.2.3-rc.1+build.5+extra", wantTag: "1.2.3-rc.1_build.5_extra"},
+		{version: "1.0.0+" + strings.Repeat("a", maxTagLength-6), wantTag: "1.0.0_" + strings.Repeat("a", maxTagLength-6)},
+		{version: "1.0.0+" + strings.Repeat("a", maxTagLength-5), wantTag: "1.0.0_" + strings.Repeat("a", maxTagLength-5), wantErr: true},
+	} {
+		t.Run(test.version, func(t *testing.T) {
+			helmChart := HelmChart{Name: "mychart", Project: "library", Version: test.version}
+
+			tag := helmChart.Tag()
+			if tag != test.wantTag {
+				t.Errorf("tag is %s, want %s", tag, test.wantTag)
+			}
+			if err := validateTag(tag); (err != nil) != test.wantErr {
+				t.Errorf("tag of length %d validated with error %v, want error %t", len(tag), err, test.wantErr)
+			}
+			if fileName := helmChart.ChartFileName(); fileName != "mychart-"+test.version+".tgz" {
+				t.Errorf("chart file name is %s, want the version kept intact", fileName)
+			}
+		})
+	}
+}
+
+func TestParseChartKey(t *testing.T) {
+	for _, test := range []struct {
+		key     string
+		want    HelmChart
+		wantErr bool
+	}{
+		{key: "library/mychart/1.0.0", want: HelmChart{Project: "library", Name: "mychart", Version: "1.0.0"}},
+		{key: "org/team/mychart/1.0.0", want: HelmChart{Project: "org/team", Name: "mychart", Version: "1.0.0"}},
+		{key: "a/b/c/mychart/1.0.0+build", want: HelmChart{Project: "a/b/c", Name: "mychart", Version: "1.0.0+build"}},
+		{key: "mychart/1.0.0", wantErr: true},
+		{key: "library/mychart/", wantErr: true},
+		{key: "org//mychart/1.0.0", wantErr: true},
+		{key: "/library/mychart/1.0.0", wantErr: true},
+	} {
+		t.Run(test.key, func(t *testing.T) {
+			helmChart, err := ParseChartKey(test.key)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parsed %s as %+v with error %v, want error %t", test.key, helmChart, err, test.wantErr)
+			}
+			if helmChart != test.want {
+				t.Errorf("parsed %s as %+v, want %+v", test.key, helmChart, test.want)
+			}
+			if !test.wantErr && helmChart.Key() != test.key {
+				t.Errorf("key of %+v is %s, want %s", helmChart, helmChart.Key(), test.key)
+			}
+		})
+	}
+}
+
+func TestValidateChart(t *testing.T) {
+	chartFilePath := filepath.Join(t.TempDir(), "myapp-1.0.0.tgz")
+	writeTestChart(t, chartFilePath, "MyApp", "apiVersion: v2\nname: MyApp\nversion: 1.0.0\n")
+
+	for _, test := range []struct {
+		helmChart HelmChart
+		wantErr   bool
+	}{
+		{helmChart: HelmChart{Name: "MyApp", Project: "library", Version: "1.0.0"}},
+		// Listed from the lowercase OCI repository of a chart artifact.
+		{helmChart: HelmChart{Name: "myapp", Project: "library", Version: "1.0.0"}},
+		{helmChart: HelmChart{Name: "other", Project: "library", Version: "1.0.0"}, wantErr: true},
+		{helmChart: HelmChart{Name: "MyApp", Project: "library", Version: "2.0.0"}, wantErr: true},
+	} {
+		t.Run(test.helmChart.String(), func(t *testing.T) {
+			if err := validateChart(chartFilePath, test.helmChart); (err != nil) != test.wantErr {
+				t.Errorf("validated chart with error %v, want error %t", err, test.wantErr)
+			}
+		})
+	}
+}
+
+// writeTestChart writes a chart archive with the Chart.yaml chartYAML in the
+// directory dirName to chartFilePath.
+func writeTestChart(t *testing.T, chartFilePath, dirName, chartYAML string) {
+	t.Helper()
+
+	var buffer bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buffer)
+	tarWriter := tar.NewWriter(gzipWriter)
+	if err := tarWriter.WriteHeader(&tar.Header{Name: dirName + "/Chart.yaml", Mode: 0o600, Size: int64(len(chartYAML)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tarWriter.Write([]byte(chartYAML)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(chartFilePath, buffer.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
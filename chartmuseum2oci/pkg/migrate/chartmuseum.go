@@ -0,0 +1,225 @@
+package migrate
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// chartMuseumRootProject is the project of the Helm charts of the root
+// repository of a ChartMuseum, migrated when no project is given.
+const chartMuseumRootProject = "library"
+
+// chartMuseumVersion is a Helm chart version listed by the ChartMuseum API.
+type chartMuseumVersion struct {
+	Version string `json:"version"`
+	Digest  string `json:"digest"`
+}
+
+// chartMuseumSource is a standalone ChartMuseum, its projects being the
+// repositories of its multitenancy, e.g. org or org/team depending on its
+// --depth.
+type chartMuseumSource struct {
+	baseURL string
+	*sourceCredentials
+	// projects are the repositories to migrate, the root one when empty.
+	projects        []string
+	excludeProjects []string
+	httpClient      *http.Client
+}
+
+// NormalizeChartMuseumURL returns the URL of a ChartMuseum given with or without
+// scheme, https being the default one, without trailing slash. Unlike Harbor,
+// ChartMuseum may be served under a path.
+func NormalizeChartMuseumURL(chartMuseumURL string) (string, error) {
+	if !strings.Contains(chartMuseumURL, "://") {
+		chartMuseumURL = "https://" + chartMuseumURL
+	}
+
+	u, err := url.Parse(chartMuseumURL)
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case u.Scheme != "https" && u.Scheme != "http":
+		return "", errors.Errorf("unsupported scheme %s, expected https or http", u.Scheme)
+	case u.Host == "":
+		return "", errors.Errorf("missing host in %s", chartMuseumURL)
+	case u.User != nil:
+		return "", errors.New("credentials must be given with the username and password flags, not in the URL")
+	case u.RawQuery != "" || u.Fragment != "":
+		return "", errors.Errorf("%s must not have a query or fragment", chartMuseumURL)
+	}
+
+	return u.Scheme + "://" + u.Host + strings.TrimRight(u.Path, "/"), nil
+}
+
+// Check checks ChartMuseum is healthy, then that it accepts the credentials by
+// listing the charts of the first repository to migrate.
+func (s *chartMuseumSource) Check(ctx context.Context) error {
+	ctx, cancel := contextWithTimeout(ctx, apiTimeout)
+	defer cancel()
+
+	res, err := s.get(ctx, s.baseURL+"/health")
+	if err != nil {
+		return errors.Wrap(err, "ChartMuseum is not reachable")
+	}
+	res.Close()
+
+	project := chartMuseumRootProject
+	if len(s.projects) > 0 {
+		project = s.projects[0]
+	}
+	res, err = s.get(ctx, s.chartsAPIURL(project))
+	if err != nil {
+		if errors.Is(err, ErrInvalidCredentials) {
+			return err
+		}
+		return errors.Wrap(err, "Failed to check credentials")
+	}
+	res.Close()
+
+	return nil
+}
+
+func (s *chartMuseumSource) ListCharts(ctx context.Context) ([]HelmChart, error) {
+	projects := s.projects
+	if len(projects) == 0 {
+		projects = []string{chartMuseumRootProject}
+	}
+
+	helmCharts := make([]HelmChart, 0)
+	for _, projectName := range excludeProjects(projects, s.excludeProjects) {
+		projectCharts, err := s.getProjectCharts(ctx, projectName)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to list Helm charts of project %s", projectName)
+		}
+		helmCharts = append(helmCharts, projectCharts...)
+	}
+
+	return helmCharts, nil
+}
+
+func (s *chartMuseumSource) getProjectCharts(ctx context.Context, projectName string) ([]HelmChart, error) {
+	ctx, cancel := contextWithTimeout(ctx, apiTimeout)
+	defer cancel()
+
+	res, err := s.get(ctx, s.chartsAPIURL(projectName))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	var charts map[string][]chartMuseumVersion
+	if err := json.NewDecoder(res).Decode(&charts); err != nil {
+		return nil, errors.Wrap(err, "Failed to parse Helm charts listing")
+	}
+
+	chartNames := make([]string, 0, len(charts))
+	for chartName := range charts {
+		chartNames = append(chartNames, chartName)
+	}
+	sort.Strings(chartNames)
+
+	helmCharts := make([]HelmChart, 0)
+	for _, chartName := range chartNames {
+		for _, version := range charts[chartName] {
+			helmCharts = append(helmCharts, HelmChart{
+				Name:    chartName,
+				Project: projectName,
+				Version: version.Version,
+				Digest:  version.Digest,
+			})
+		}
+	}
+
+	return helmCharts, nil
+}
+
+func (s *chartMuseumSource) PullChart(ctx context.Context, helmChart HelmChart) (io.ReadCloser, error) {
+	return s.get(ctx, s.ChartURL(helmChart))
+}
+
+func (s *chartMuseumSource) ResumeChart(ctx context.Context, helmChart HelmChart, offset int64) (io.ReadCloser, int64, error) {
+	return s.download(ctx, s.ChartURL(helmChart), offset)
+}
+
+func (s *chartMuseumSource) PullProvenance(ctx context.Context, helmChart HelmChart) (io.ReadCloser, error) {
+	return s.get(ctx, s.ChartURL(helmChart)+provenanceFileSuffix)
+}
+
+// DeleteChart deletes helmChart with the ChartMuseum API, which must be run
+// without --disable-delete.
+func (s *chartMuseumSource) DeleteChart(ctx context.Context, helmChart HelmChart) error {
+	ctx, cancel := contextWithTimeout(ctx, apiTimeout)
+	defer cancel()
+
+	chartURL := s.chartsAPIURL(helmChart.Project) + "/" + url.PathEscape(helmChart.Name) + "/" + url.PathEscape(helmChart.Version)
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, chartURL, nil)
+	if err != nil {
+		return err
+	}
+	if !s.empty() {
+		s.setAuth(req)
+	}
+
+	res, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return checkDownloadStatus(res)
+}
+
+func (s *chartMuseumSource) ChartURL(helmChart HelmChart) string {
+	return s.baseURL + s.repositoryPath(helmChart.Project) + "/charts/" + helmChart.ChartFileName()
+}
+
+// chartsAPIURL returns the URL of the API listing the charts of projectName.
+func (s *chartMuseumSource) chartsAPIURL(projectName string) string {
+	return s.baseURL + "/api" + s.repositoryPath(projectName) + "/charts"
+}
+
+// repositoryPath returns the path of the repository of projectName within the
+// ChartMuseum routes, the root one having an empty path.
+func (s *chartMuseumSource) repositoryPath(projectName string) string {
+	if len(s.projects) == 0 && projectName == chartMuseumRootProject {
+		return ""
+	}
+	return "/" + strings.Trim(projectName, "/")
+}
+
+func (s *chartMuseumSource) get(ctx context.Context, fileURL string) (io.ReadCloser, error) {
+	content, _, err := s.download(ctx, fileURL, 0)
+	return content, err
+}
+
+// download GETs fileURL from offset, if not 0, returning the offset its content
+// actually starts at.
+func (s *chartMuseumSource) download(ctx context.Context, fileURL string, offset int64) (io.ReadCloser, int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !s.empty() {
+		s.setAuth(req)
+	}
+	setRange(req, offset)
+
+	res, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := checkDownloadStatus(res); err != nil {
+		res.Body.Close()
+		return nil, 0, err
+	}
+	return newHTTPContent(res, offset)
+}
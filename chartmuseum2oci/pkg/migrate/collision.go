@@ -0,0 +1,60 @@
+package migrate
+
+import (
+	"fmt"
+	"path"
+	"slices"
+)
+
+// Collision is a destination reference several source Helm charts would be
+// pushed to, each of them overwriting the previous one.
+type Collision struct {
+	// Reference is the project/repository:tag of the OCI artifact, or the
+	// project/name-version.tgz chart file of a dir destination.
+	Reference  string
+	HelmCharts []HelmChart
+}
+
+// Collisions returns the destination references several of helmCharts would be
+// pushed to, once mapped and renamed, e.g. the ones of a same name and version
+// in several source projects with Flatten or mapped to the same project, sorted
+// by reference. The Helm charts whose rewritten name is invalid are left out,
+// failing to migrate anyway.
+func (m *Migrator) Collisions(helmCharts []HelmChart) []Collision {
+	chartsByReference := make(map[string][]HelmChart)
+	references := make([]string, 0)
+	for _, helmChart := range helmCharts {
+		if len(m.nameRewrites) > 0 {
+			var err error
+			if helmChart.NewName, err = m.rewriteName(helmChart.Name); err != nil {
+				continue
+			}
+		}
+		reference := m.destinationReference(helmChart)
+		collidingCharts, ok := chartsByReference[reference]
+		if !ok {
+			references = append(references, reference)
+		}
+		if !slices.ContainsFunc(collidingCharts, func(hc HelmChart) bool { return hc.Key() == helmChart.Key() }) {
+			chartsByReference[reference] = append(collidingCharts, helmChart)
+		}
+	}
+	slices.Sort(references)
+
+	collisions := make([]Collision, 0)
+	for _, reference := range references {
+		if collidingCharts := chartsByReference[reference]; len(collidingCharts) > 1 {
+			collisions = append(collisions, Collision{Reference: reference, HelmCharts: collidingCharts})
+		}
+	}
+	return collisions
+}
+
+// destinationReference returns the reference helmChart is pushed to in the
+// destinations, as reported by Collisions.
+func (m *Migrator) destinationReference(helmChart HelmChart) string {
+	if m.opts.DestinationType == DestinationTypeDir {
+		return path.Join(m.destinationProject(helmChart), fmt.Sprintf("%s-%s.tgz", helmChart.DestinationName(), helmChart.Version))
+	}
+	return path.Join(m.destinationProject(helmChart), m.destinationRepository(helmChart)) + ":" + helmChart.Tag()
+}
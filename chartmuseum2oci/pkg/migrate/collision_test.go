@@ -0,0 +1,76 @@
+package migrate
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestCollisions(t *testing.T) {
+	helmCharts := []HelmChart{
+		{Name: "mychart", Project: "team-a", Version: "1.0.0"},
+		{Name: "mychart", Project: "team-b", Version: "1.0.0"},
+		{Name: "mychart", Project: "team-b", Version: "2.0.0"},
+		{Name: "other", Project: "team-b", Version: "1.0.0"},
+		// Listed twice, e.g. by a --from-file with duplicates.
+		{Name: "other", Project: "team-b", Version: "1.0.0"},
+	}
+	for _, test := range []struct {
+		name         string
+		opts         Options
+		nameRewrites []NameRewrite
+		want         map[string][]string
+	}{
+		{
+			name: "none",
+			want: map[string][]string{},
+		},
+		{
+			name: "flatten",
+			opts: Options{DestPath: "platform", Flatten: true},
+			want: map[string][]string{"platform/mychart:1.0.0": {"team-a/mychart/1.0.0", "team-b/mychart/1.0.0"}},
+		},
+		{
+			name: "flatten dir",
+			opts: Options{DestinationType: DestinationTypeDir, Flatten: true},
+			want: map[string][]string{"mychart-1.0.0.tgz": {"team-a/mychart/1.0.0", "team-b/mychart/1.0.0"}},
+		},
+		{
+			name: "map",
+			opts: Options{ProjectMapping: map[string]string{"team-a": "platform", "team-b": "platform"}},
+			want: map[string][]string{"platform/mychart:1.0.0": {"team-a/mychart/1.0.0", "team-b/mychart/1.0.0"}},
+		},
+		{
+			name:         "name rewrite",
+			nameRewrites: []NameRewrite{{Pattern: "^other$", Replacement: "mychart"}},
+			want:         map[string][]string{"team-b/mychart:1.0.0": {"team-b/mychart/1.0.0", "team-b/other/1.0.0"}},
+		},
+		{
+			name:         "invalid name rewrite",
+			opts:         Options{ProjectMapping: map[string]string{"team-a": "team-b"}},
+			nameRewrites: []NameRewrite{{Pattern: "^mychart$", Replacement: "my/chart"}},
+			want:         map[string][]string{},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			nameRewrites, err := compileNameRewrites(test.nameRewrites)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := &Migrator{opts: test.opts, nameRewrites: nameRewrites}
+
+			collisions := m.Collisions(helmCharts)
+			if len(collisions) != len(test.want) {
+				t.Fatalf("collisions are %+v, want %v", collisions, test.want)
+			}
+			for _, collision := range collisions {
+				keys := make([]string, 0, len(collision.HelmCharts))
+				for _, helmChart := range collision.HelmCharts {
+					keys = append(keys, helmChart.Key())
+				}
+				if want, ok := test.want[collision.Reference]; !ok || !slices.Equal(keys, want) {
+					t.Errorf("Helm charts %v collide at %s, want %v", keys, collision.Reference, want)
+				}
+			}
+		})
+	}
+}
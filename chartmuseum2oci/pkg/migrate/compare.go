@@ -0,0 +1,189 @@
+package migrate
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Values of Drift.Problem.
+const (
+	DriftMissing        = "missing"
+	DriftDigestMismatch = "digest-mismatch"
+)
+
+// DigestChartDestination is a ChartDestination able to tell the digest of the
+// chart files it has, compared by Compare to the ones listed by the source.
+type DigestChartDestination interface {
+	ChartDestination
+	// ChartDigest returns the hex encoded SHA256 of the chart file of
+	// helmChart, ErrNotFound when the destination does not have it.
+	ChartDigest(ctx context.Context, helmChart HelmChart) (string, error)
+}
+
+// CountingChartDestination is a ChartDestination able to count the Helm chart
+// versions of its projects, compared by CompareCounts to the source ones.
+type CountingChartDestination interface {
+	ChartDestination
+	// CountCharts returns the number of Helm chart versions of the destination
+	// project projectName, 0 when it does not exist.
+	CountCharts(ctx context.Context, projectName string) (int, error)
+}
+
+// CountMismatch is a destination project whose number of Helm chart versions in
+// a destination differs from the number of source ones migrated to it.
+type CountMismatch struct {
+	Project          string
+	Destination      string
+	SourceCount      int
+	DestinationCount int
+}
+
+// Drift is a Helm chart of the source which a destination does not have, or
+// has with another chart file.
+type Drift struct {
+	HelmChart
+	Destination string
+	Problem     string
+	// SourceDigest and DestinationDigest are the digests of the chart files of
+	// a DriftDigestMismatch.
+	SourceDigest      string
+	DestinationDigest string
+}
+
+// Compare checks every destination has helmCharts, using a pool of Concurrency
+// workers, and returns the drifts found, in the order of helmCharts. The chart
+// files are compared by digest when the source lists it and the destination is
+// a DigestChartDestination, unless the Helm charts are renamed or rewritten,
+// their repackaged chart files having another digest.
+func (m *Migrator) Compare(ctx context.Context, helmCharts []HelmChart) ([]Drift, error) {
+	if len(m.destinations) == 0 {
+		return nil, errors.New("No destination to compare to, the migrator only lists Helm charts")
+	}
+
+	chartDrifts := make([][]Drift, len(helmCharts))
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	var wg sync.WaitGroup
+	indexes := make(chan int)
+	for i := 0; i < m.opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				drifts, err := m.compareChart(ctx, helmCharts[index])
+				if err != nil {
+					cancel(errors.Wrapf(err, "Failed to compare Helm chart %s", helmCharts[index]))
+					continue
+				}
+				chartDrifts[index] = drifts
+			}
+		}()
+	}
+
+schedule:
+	for i := range helmCharts {
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+			break schedule
+		}
+	}
+	close(indexes)
+	wg.Wait()
+	if err := context.Cause(ctx); err != nil {
+		return nil, err
+	}
+
+	drifts := make([]Drift, 0)
+	for _, chartDrift := range chartDrifts {
+		drifts = append(drifts, chartDrift...)
+	}
+	return drifts, nil
+}
+
+// compareChart returns the drifts of helmChart in the destinations.
+func (m *Migrator) compareChart(ctx context.Context, helmChart HelmChart) ([]Drift, error) {
+	if len(m.nameRewrites) > 0 {
+		var err error
+		if helmChart.NewName, err = m.rewriteName(helmChart.Name); err != nil {
+			return nil, err
+		}
+	}
+	compareDigest := helmChart.Digest != "" && helmChart.DestinationName() == helmChart.Name &&
+		len(m.imageRewrites) == 0 && len(m.dependencyRewrites(helmChart)) == 0
+
+	drifts := make([]Drift, 0)
+	for _, destination := range m.destinations {
+		drift := Drift{HelmChart: helmChart, Destination: destination.String()}
+		if digestDestination, ok := destination.(DigestChartDestination); ok && compareDigest {
+			var digest string
+			err := m.withRetry(ctx, "digest", helmChart, func() (err error) {
+				digest, err = digestDestination.ChartDigest(ctx, helmChart)
+				return err
+			})
+			switch {
+			case errors.Is(err, ErrNotFound):
+				drift.Problem = DriftMissing
+			case err != nil:
+				return nil, errors.Wrapf(err, "Failed to get digest of chart in destination %s", destination)
+			case digest != helmChart.Digest:
+				drift.Problem, drift.SourceDigest, drift.DestinationDigest = DriftDigestMismatch, helmChart.Digest, digest
+			}
+		} else {
+			exists, err := destination.ChartExists(ctx, helmChart)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Failed to check chart in destination %s", destination)
+			}
+			if !exists {
+				drift.Problem = DriftMissing
+			}
+		}
+
+		if drift.Problem != "" {
+			drifts = append(drifts, drift)
+		}
+	}
+	return drifts, nil
+}
+
+// CompareCounts compares the number of helmCharts of each destination project
+// with the number of Helm chart versions of the project in every
+// CountingChartDestination, returning the projects whose counts differ. It is
+// cheaper than Compare, only catching whole projects or charts left behind.
+func (m *Migrator) CompareCounts(ctx context.Context, helmCharts []HelmChart) ([]CountMismatch, error) {
+	sourceCounts := make(map[string]int)
+	for _, helmChart := range helmCharts {
+		sourceCounts[m.destinationProject(helmChart)]++
+	}
+	projectNames := make([]string, 0, len(sourceCounts))
+	for projectName := range sourceCounts {
+		projectNames = append(projectNames, projectName)
+	}
+	slices.Sort(projectNames)
+
+	mismatches := make([]CountMismatch, 0)
+	for _, destination := range m.destinations {
+		counter, ok := destination.(CountingChartDestination)
+		if !ok {
+			continue
+		}
+		for _, projectName := range projectNames {
+			count, err := counter.CountCharts(ctx, projectName)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Failed to count Helm charts of project %s in destination %s", projectName, destination)
+			}
+			if count != sourceCounts[projectName] {
+				mismatches = append(mismatches, CountMismatch{
+					Project:          projectName,
+					Destination:      destination.String(),
+					SourceCount:      sourceCounts[projectName],
+					DestinationCount: count,
+				})
+			}
+		}
+	}
+	return mismatches, nil
+}
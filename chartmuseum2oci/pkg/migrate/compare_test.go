@@ -0,0 +1,79 @@
+package migrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompare(t *testing.T) {
+	chartContent := []byte("chart")
+	digest := sha256.Sum256(chartContent)
+	chartDigest := hex.EncodeToString(digest[:])
+
+	m := &Migrator{
+		opts:   Options{Concurrency: 2, DestinationType: DestinationTypeDir},
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	dir := t.TempDir()
+	m.destinations = []ChartDestination{newDirDestination(dir, m.destinationProject, m.logger)}
+	for fileName, content := range map[string]string{
+		"library/synced-1.0.0.tgz":   "chart",
+		"library/changed-1.0.0.tgz":  "changed chart",
+		"library/nodigest-1.0.0.tgz": "changed chart",
+	} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, fileName)), dirMode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, fileName), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	helmCharts := []HelmChart{
+		{Name: "synced", Project: "library", Version: "1.0.0", Digest: chartDigest},
+		{Name: "missing", Project: "library", Version: "1.0.0", Digest: chartDigest},
+		{Name: "changed", Project: "library", Version: "1.0.0", Digest: chartDigest},
+		{Name: "nodigest", Project: "library", Version: "1.0.0"},
+		{Name: "synced", Project: "other", Version: "1.0.0"},
+	}
+	drifts, err := m.Compare(context.Background(), helmCharts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Drift{
+		{HelmChart: helmCharts[1], Destination: dir, Problem: DriftMissing},
+		{HelmChart: helmCharts[2], Destination: dir, Problem: DriftDigestMismatch, SourceDigest: chartDigest, DestinationDigest: mustFileDigest(t, filepath.Join(dir, "library/changed-1.0.0.tgz"))},
+		{HelmChart: helmCharts[4], Destination: dir, Problem: DriftMissing},
+	}
+	if len(drifts) != len(want) {
+		t.Fatalf("drifts are %+v, want %+v", drifts, want)
+	}
+	for i := range want {
+		if drifts[i] != want[i] {
+			t.Errorf("drift %d is %+v, want %+v", i, drifts[i], want[i])
+		}
+	}
+}
+
+func TestCompareWithoutDestination(t *testing.T) {
+	m := &Migrator{opts: Options{Concurrency: 1}}
+	if _, err := m.Compare(context.Background(), []HelmChart{{Name: "mychart", Project: "library", Version: "1.0.0"}}); err == nil {
+		t.Error("compared Helm charts without destination")
+	}
+}
+
+func mustFileDigest(t *testing.T, filePath string) string {
+	t.Helper()
+	digest, err := fileDigest(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return digest
+}
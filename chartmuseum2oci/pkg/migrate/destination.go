@@ -0,0 +1,286 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// Values of Options.DestinationType.
+const (
+	DestinationTypeHarbor = "harbor"
+	DestinationTypeDir    = "dir"
+)
+
+const indexFileName = "index.yaml"
+
+// ChartDestination is a repository the Helm charts are migrated to.
+type ChartDestination interface {
+	// String identifies the destination in the logs and reports.
+	String() string
+	// Check checks the destination is reachable and accepts its credentials.
+	Check(ctx context.Context) error
+	// ChartExists tells whether the destination already has helmChart.
+	ChartExists(ctx context.Context, helmChart HelmChart) (bool, error)
+	// PushChart pushes the chart file of helmChart at chartFilePath, along with
+	// the provenance file next to it if any, returning a retryable error on a
+	// transient failure.
+	PushChart(ctx context.Context, helmChart HelmChart, chartFilePath string) error
+	// VerifyChart checks the pushed helmChart matches the chart file at
+	// chartFilePath.
+	VerifyChart(ctx context.Context, helmChart HelmChart, chartFilePath string) error
+	// ChartURL returns the URL of the repository of helmChart, as logged by dry
+	// runs.
+	ChartURL(helmChart HelmChart) string
+	// Finish completes the migration once all the Helm charts were pushed.
+	Finish(ctx context.Context) error
+}
+
+// dirDestination writes the Helm charts into a directory per destination
+// project, each of them being a classic Helm repository with its index.yaml.
+type dirDestination struct {
+	dir                string
+	destinationProject func(HelmChart) string
+	logger             *slog.Logger
+
+	mutex sync.Mutex
+	// pushedProjects are the projects the index.yaml of which is outdated.
+	pushedProjects map[string]bool
+}
+
+func newDirDestination(dir string, destinationProject func(HelmChart) string, logger *slog.Logger) *dirDestination {
+	return &dirDestination{
+		dir:                dir,
+		destinationProject: destinationProject,
+		logger:             logger,
+		pushedProjects:     make(map[string]bool),
+	}
+}
+
+func (d *dirDestination) String() string {
+	return d.dir
+}
+
+func (d *dirDestination) Check(context.Context) error {
+	return os.MkdirAll(d.dir, dirMode)
+}
+
+func (d *dirDestination) ChartExists(_ context.Context, helmChart HelmChart) (bool, error) {
+	_, err := os.Stat(d.chartPath(helmChart))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (d *dirDestination) PushChart(_ context.Context, helmChart HelmChart, chartFilePath string) error {
+	if err := copyFile(chartFilePath, d.chartPath(helmChart)); err != nil {
+		return err
+	}
+
+	provenancePath := d.chartPath(helmChart) + provenanceFileSuffix
+	err := copyFile(chartFilePath+provenanceFileSuffix, provenancePath)
+	if os.IsNotExist(err) {
+		// A provenance file of a previous push no longer matches the chart.
+		err = os.Remove(provenancePath)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	d.mutex.Lock()
+	d.pushedProjects[d.destinationProject(helmChart)] = true
+	d.mutex.Unlock()
+	return nil
+}
+
+func (d *dirDestination) VerifyChart(_ context.Context, helmChart HelmChart, chartFilePath string) error {
+	pushedDigest, err := fileDigest(chartFilePath)
+	if err != nil {
+		return errors.Wrap(err, "Failed to compute digest of pushed chart")
+	}
+	writtenDigest, err := fileDigest(d.chartPath(helmChart))
+	if err != nil {
+		return errors.Wrap(err, "Failed to compute digest of written chart")
+	}
+	if writtenDigest != pushedDigest {
+		return errors.Errorf("digest mismatch, pushed %s but wrote %s", pushedDigest, writtenDigest)
+	}
+	return nil
+}
+
+func (d *dirDestination) ChartDigest(_ context.Context, helmChart HelmChart) (string, error) {
+	digest, err := fileDigest(d.chartPath(helmChart))
+	if os.IsNotExist(err) {
+		return "", ErrNotFound
+	}
+	return digest, err
+}
+
+func (d *dirDestination) CountCharts(_ context.Context, projectName string) (int, error) {
+	chartFiles, err := filepath.Glob(filepath.Join(d.dir, projectName, "*.tgz"))
+	return len(chartFiles), err
+}
+
+func (d *dirDestination) ChartURL(helmChart HelmChart) string {
+	return filepath.Join(d.dir, d.destinationProject(helmChart))
+}
+
+// Finish regenerates the index.yaml of the projects Helm charts were pushed to.
+func (d *dirDestination) Finish(context.Context) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for projectName := range d.pushedProjects {
+		if err := writeIndex(filepath.Join(d.dir, projectName)); err != nil {
+			return errors.Wrapf(err, "Failed to write %s of project %s", indexFileName, projectName)
+		}
+		d.logger.Info("Wrote Helm repository index", "project", projectName)
+		delete(d.pushedProjects, projectName)
+	}
+	return nil
+}
+
+// chartPath returns the path helmChart is written to, under its destination
+// name as it may have been renamed.
+func (d *dirDestination) chartPath(helmChart HelmChart) string {
+	fileName := fmt.Sprintf("%s-%s.tgz", helmChart.DestinationName(), helmChart.Version)
+	return filepath.Join(d.dir, d.destinationProject(helmChart), fileName)
+}
+
+// copyFile copies the file at srcPath to dstPath, which is only replaced once
+// the copy is complete.
+func copyFile(srcPath, dstPath string) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	return writeChartFile(dstPath, src, "")
+}
+
+// writeIndex writes the index.yaml of the Helm repository in dir, listing all
+// the chart files it has, the highest versions first. The entries of an
+// existing index.yaml are merged, the ones of other charts being kept and the
+// creation date of the unchanged ones preserved.
+func writeIndex(dir string) error {
+	chartFiles, err := filepath.Glob(filepath.Join(dir, "*.tgz"))
+	if err != nil {
+		return err
+	}
+
+	entries, err := readIndexEntries(filepath.Join(dir, indexFileName))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to read existing %s", indexFileName)
+	}
+	for _, chartFile := range chartFiles {
+		entry, err := indexEntry(chartFile)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to index chart file %s", filepath.Base(chartFile))
+		}
+		name := fmt.Sprint(entry["name"])
+		entries[name] = mergeIndexEntry(entries[name], entry)
+	}
+	for _, versions := range entries {
+		sort.SliceStable(versions, func(i, j int) bool {
+			return compareVersions(fmt.Sprint(versions[i]["version"]), fmt.Sprint(versions[j]["version"])) > 0
+		})
+	}
+
+	index := map[string]any{
+		"apiVersion": "v1",
+		"entries":    entries,
+		"generated":  time.Now().UTC().Format(time.RFC3339),
+	}
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(yamlIndent)
+	if err := encoder.Encode(index); err != nil {
+		return err
+	}
+
+	return writeChartFile(filepath.Join(dir, indexFileName), &buf, "")
+}
+
+// readIndexEntries returns the entries of the index.yaml at indexPath, none
+// when it does not exist.
+func readIndexEntries(indexPath string) (map[string][]map[string]any, error) {
+	content, err := os.ReadFile(indexPath)
+	if os.IsNotExist(err) {
+		return make(map[string][]map[string]any), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var index struct {
+		Entries map[string][]map[string]any `yaml:"entries"`
+	}
+	if err := yaml.Unmarshal(content, &index); err != nil {
+		return nil, err
+	}
+	if index.Entries == nil {
+		index.Entries = make(map[string][]map[string]any)
+	}
+	return index.Entries, nil
+}
+
+// mergeIndexEntry returns the versions of a chart with entry replacing the one
+// of the same version if any, keeping its creation date when the digest did not
+// change.
+func mergeIndexEntry(versions []map[string]any, entry map[string]any) []map[string]any {
+	version := fmt.Sprint(entry["version"])
+	for i, existing := range versions {
+		if fmt.Sprint(existing["version"]) != version {
+			continue
+		}
+		if existing["digest"] == entry["digest"] && existing["created"] != nil {
+			entry["created"] = existing["created"]
+		}
+		versions[i] = entry
+		return versions
+	}
+	return append(versions, entry)
+}
+
+// indexEntry returns the index.yaml entry of the chart file at chartFile, its
+// Chart.yaml along with its digest, creation date and relative URL.
+func indexEntry(chartFile string) (map[string]any, error) {
+	chartMetadata, err := readChartMetadata(chartFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var entry map[string]any
+	if err := yaml.Unmarshal(chartMetadata, &entry); err != nil {
+		return nil, errors.Wrapf(err, "invalid %s", chartMetadataFileName)
+	}
+	if entry == nil || entry["name"] == nil || entry["version"] == nil {
+		return nil, errors.Errorf("%s has no name or version", chartMetadataFileName)
+	}
+
+	digest, err := fileDigest(chartFile)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(chartFile)
+	if err != nil {
+		return nil, err
+	}
+
+	entry["digest"] = digest
+	entry["created"] = info.ModTime().UTC().Format(time.RFC3339)
+	entry["urls"] = []string{filepath.Base(chartFile)}
+	return entry, nil
+}
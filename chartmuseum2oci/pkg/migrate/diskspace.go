@@ -0,0 +1,43 @@
+package migrate
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+var errNotEnoughDiskSpace = errors.New("not enough disk space in work directory")
+
+// checkFreeSpace checks the filesystem of the work directory has room for size
+// more bytes on top of the MinFreeSpace margin. Filesystems the free space of
+// which is unknown are assumed to have room.
+func (m *Migrator) checkFreeSpace(size int64) error {
+	available, ok, err := freeSpace(m.workDir)
+	if err != nil {
+		return errors.Wrap(err, "Failed to get free disk space of work directory")
+	}
+	if !ok {
+		return nil
+	}
+
+	if required := size + m.opts.MinFreeSpace; available < required {
+		return errors.Wrapf(errNotEnoughDiskSpace, "Only %s available of the %s required", FormatSize(available), FormatSize(required))
+	}
+	return nil
+}
+
+// FormatSize returns a number of bytes in a human-readable form, e.g. 1.5MiB.
+func FormatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%dB", size)
+	}
+
+	value := float64(size) / unit
+	units := "KMGTPE"
+	i := 0
+	for ; value >= unit && i < len(units)-1; i++ {
+		value /= unit
+	}
+	return fmt.Sprintf("%.1f%ciB", value, units[i])
+}
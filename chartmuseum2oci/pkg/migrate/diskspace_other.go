@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+
+package migrate
+
+// freeSpace does not know the free space of the filesystems of this platform.
+func freeSpace(string) (int64, bool, error) {
+	return 0, false, nil
+}
@@ -0,0 +1,15 @@
+//go:build linux || darwin
+
+package migrate
+
+import "syscall"
+
+// freeSpace returns the number of bytes available to unprivileged users on the
+// filesystem of dir.
+func freeSpace(dir string) (int64, bool, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, false, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), true, nil
+}
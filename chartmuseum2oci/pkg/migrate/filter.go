@@ -0,0 +1,148 @@
+package migrate
+
+import (
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/pkg/errors"
+)
+
+// compileNameFilters compiles the nameFilters globs and nameRegexps patterns,
+// case-insensitive unless caseSensitive is set.
+func compileNameFilters(nameFilters, nameRegexps []string, caseSensitive bool) ([]func(name string) bool, error) {
+	nameMatchers := make([]func(name string) bool, 0, len(nameFilters)+len(nameRegexps))
+	for _, glob := range nameFilters {
+		glob := glob
+		if !caseSensitive {
+			glob = strings.ToLower(glob)
+		}
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, errors.Wrapf(err, "Invalid --name-filter %s", glob)
+		}
+		nameMatchers = append(nameMatchers, func(name string) bool {
+			if !caseSensitive {
+				name = strings.ToLower(name)
+			}
+			matched, _ := path.Match(glob, name)
+			return matched
+		})
+	}
+
+	for _, pattern := range nameRegexps {
+		if !caseSensitive {
+			pattern = "(?i)" + pattern
+		}
+		nameRegexp, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid --name-regex %s", pattern)
+		}
+		nameMatchers = append(nameMatchers, nameRegexp.MatchString)
+	}
+
+	return nameMatchers, nil
+}
+
+// filterCharts returns the Helm charts selected by the filtering options.
+func (m *Migrator) filterCharts(helmCharts []HelmChart) []HelmChart {
+	filtered := make([]HelmChart, 0, len(helmCharts))
+	for _, helmChart := range helmCharts {
+		if m.matchesNameFilters(helmChart) && m.matchesVersionConstraint(helmChart) && !m.isSkippedPrerelease(helmChart) {
+			filtered = append(filtered, helmChart)
+		}
+	}
+
+	if m.opts.LatestVersions > 0 {
+		filtered = keepLatestVersions(filtered, m.opts.LatestVersions)
+	}
+	return filtered
+}
+
+// isSkippedPrerelease tells whether the chart version is a prerelease skipped by
+// SkipPrereleases, versions which are not valid SemVer not being prereleases.
+func (m *Migrator) isSkippedPrerelease(helmChart HelmChart) bool {
+	if !m.opts.SkipPrereleases {
+		return false
+	}
+
+	version, err := semver.NewVersion(helmChart.Version)
+	return err == nil && version.Prerelease() != ""
+}
+
+// keepLatestVersions keeps the count highest versions, by SemVer precedence, of
+// each chart. Versions which are not valid SemVer rank below all the valid ones.
+func keepLatestVersions(helmCharts []HelmChart, count int) []HelmChart {
+	type chartKey struct{ project, name string }
+	versionsByChart := make(map[chartKey][]HelmChart)
+	charts := make([]chartKey, 0)
+	for _, helmChart := range helmCharts {
+		key := chartKey{project: helmChart.Project, name: helmChart.Name}
+		if _, ok := versionsByChart[key]; !ok {
+			charts = append(charts, key)
+		}
+		versionsByChart[key] = append(versionsByChart[key], helmChart)
+	}
+
+	latest := make([]HelmChart, 0, len(helmCharts))
+	for _, key := range charts {
+		versions := versionsByChart[key]
+		sort.SliceStable(versions, func(i, j int) bool {
+			return compareVersions(versions[i].Version, versions[j].Version) > 0
+		})
+		if len(versions) > count {
+			versions = versions[:count]
+		}
+		latest = append(latest, versions...)
+	}
+	return latest
+}
+
+// compareVersions compares two versions by SemVer precedence, versions which are
+// not valid SemVer being lower than valid ones and compared as strings.
+func compareVersions(a, b string) int {
+	versionA, errA := semver.NewVersion(a)
+	versionB, errB := semver.NewVersion(b)
+	switch {
+	case errA == nil && errB == nil:
+		return versionA.Compare(versionB)
+	case errA == nil:
+		return 1
+	case errB == nil:
+		return -1
+	default:
+		return strings.Compare(a, b)
+	}
+}
+
+// matchesNameFilters tells whether the chart name matches any of the name filters.
+func (m *Migrator) matchesNameFilters(helmChart HelmChart) bool {
+	if len(m.nameMatchers) == 0 {
+		return true
+	}
+
+	for _, matches := range m.nameMatchers {
+		if matches(helmChart.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Migrator) matchesVersionConstraint(helmChart HelmChart) bool {
+	if m.opts.VersionConstraint == nil {
+		return true
+	}
+
+	version, err := semver.NewVersion(helmChart.Version)
+	if err != nil {
+		if m.opts.IncludeInvalidVersions {
+			return true
+		}
+		m.logger.Warn("Skipping Helm chart, version is not valid SemVer", chartAttrs(helmChart)...)
+		return false
+	}
+
+	return m.opts.VersionConstraint.Check(version)
+}
@@ -0,0 +1,263 @@
+package migrate
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	httptransport "github.com/go-openapi/runtime/client"
+	"github.com/goharbor/go-client/pkg/harbor"
+	assistClient "github.com/goharbor/go-client/pkg/sdk/assist/client"
+	"github.com/goharbor/go-client/pkg/sdk/v2.0/client"
+	"github.com/goharbor/go-client/pkg/sdk/v2.0/client/artifact"
+	"github.com/goharbor/go-client/pkg/sdk/v2.0/client/ping"
+	"github.com/goharbor/go-client/pkg/sdk/v2.0/client/project"
+	"github.com/goharbor/go-client/pkg/sdk/v2.0/client/repository"
+	"github.com/pkg/errors"
+)
+
+// harborClient gathers the API clients of a Harbor instance.
+type harborClient struct {
+	v2     *client.HarborAPI
+	assist *assistClient.HarborAPI
+}
+
+// newHarborClient returns the API clients of the Harbor at harborURL, sending
+// their requests through transport, authenticated with the bearer token if not
+// empty and with basic auth otherwise.
+func newHarborClient(harborURL, username, password, token string, transport http.RoundTripper) (*harborClient, error) {
+	u, err := url.Parse(harborURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to parse Harbor URL")
+	}
+
+	config := &harbor.Config{
+		URL:       u,
+		Transport: transport,
+		AuthInfo:  httptransport.BasicAuth(username, password),
+	}
+	if token != "" {
+		config.AuthInfo = httptransport.BearerToken(token)
+	}
+
+	return &harborClient{
+		v2:     client.New(config.ToV2Config()),
+		assist: assistClient.New(config.ToAssistConfig()),
+	}, nil
+}
+
+// NormalizeHarborURL returns the scheme://host[:port] URL of a Harbor given with
+// or without scheme, https being the default one, along with its host[:port].
+func NormalizeHarborURL(harborURL string) (string, string, error) {
+	if !strings.Contains(harborURL, "://") {
+		harborURL = "https://" + harborURL
+	}
+
+	u, err := url.Parse(harborURL)
+	if err != nil {
+		return "", "", err
+	}
+
+	switch {
+	case u.Scheme != "https" && u.Scheme != "http":
+		return "", "", errors.Errorf("unsupported scheme %s, expected https or http", u.Scheme)
+	case u.Host == "":
+		return "", "", errors.Errorf("missing host in %s", harborURL)
+	case u.User != nil:
+		return "", "", errors.New("credentials must be given with the username and password flags, not in the URL")
+	case strings.Trim(u.Path, "/") != "" || u.RawQuery != "" || u.Fragment != "":
+		return "", "", errors.Errorf("%s must not have a path, query or fragment", harborURL)
+	}
+
+	return u.Scheme + "://" + u.Host, u.Host, nil
+}
+
+// ErrInvalidCredentials is returned when the source or a destination rejects
+// the credentials.
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// checkHarbor checks the Harbor of apiClient is reachable and accepts its
+// credentials, returning ErrInvalidCredentials when it does not.
+func checkHarbor(ctx context.Context, apiClient *client.HarborAPI) error {
+	ctx, cancel := contextWithTimeout(ctx, apiTimeout)
+	defer cancel()
+
+	if _, err := apiClient.Ping.GetPing(ctx, ping.NewGetPingParams()); err != nil {
+		return errors.Wrap(err, "Harbor is not reachable")
+	}
+
+	// Any authenticated API call is rejected with invalid credentials, even
+	// the ones anonymous users can make.
+	pageSize := int64(1)
+	if _, err := apiClient.Project.ListProjects(ctx, project.NewListProjectsParams().WithPageSize(&pageSize)); err != nil {
+		var unauthorized *project.ListProjectsUnauthorized
+		if errors.As(err, &unauthorized) {
+			return ErrInvalidCredentials
+		}
+		return errors.Wrap(err, "Failed to check credentials")
+	}
+
+	return nil
+}
+
+// ListCharts returns the source Helm charts selected by the filtering options,
+// sorted by SortCharts whatever the order of the source.
+func (m *Migrator) ListCharts(ctx context.Context) ([]HelmChart, error) {
+	helmCharts, err := m.source.ListCharts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	helmCharts = m.filterCharts(helmCharts)
+	SortCharts(helmCharts)
+	return helmCharts, nil
+}
+
+// destinationProject returns the name of the project of the chart in the
+// destination, as mapped by the ProjectMapping if any, or the first segment of
+// the DestPath with Flatten, none for a dir destination.
+func (m *Migrator) destinationProject(helmChart HelmChart) string {
+	if m.opts.Flatten {
+		if m.opts.DestinationType == DestinationTypeDir {
+			return ""
+		}
+		project, _, _ := strings.Cut(m.normalizedDestPath(), "/")
+		return project
+	}
+	if mappedProject, ok := m.opts.ProjectMapping[helmChart.Project]; ok {
+		return strings.ToLower(mappedProject)
+	}
+	return strings.ToLower(helmChart.Project)
+}
+
+// destinationRepository returns the name, within its project, of the destination
+// repository of a Helm chart.
+func (m *Migrator) destinationRepository(helmChart HelmChart) string {
+	return path.Join(m.repositoryPrefix(), helmChart.DestinationName())
+}
+
+// repositoryPrefix returns the path of the destination repositories within
+// their project, the DestPath but for its first segment with Flatten.
+func (m *Migrator) repositoryPrefix() string {
+	if m.opts.Flatten {
+		_, prefix, _ := strings.Cut(m.normalizedDestPath(), "/")
+		return prefix
+	}
+	return m.normalizedDestPath()
+}
+
+// normalizedDestPath returns the lowercase DestPath without leading, trailing
+// or duplicate slashes, whichever way it was given.
+func (m *Migrator) normalizedDestPath() string {
+	return strings.Trim(path.Clean("/"+strings.ToLower(m.opts.DestPath)), "/")
+}
+
+// harborDestination is the OCI registry of a Harbor, sharing the helm and TLS
+// configuration of its Migrator.
+type harborDestination struct {
+	m *Migrator
+	// url is the scheme://host[:port] of the Harbor, registry its host[:port].
+	url       string
+	registry  string
+	username  string
+	password  string
+	token     string
+	apiClient *harborClient
+	projects  *destinationProjects
+}
+
+func (d *harborDestination) String() string {
+	return d.registry
+}
+
+func (d *harborDestination) Check(ctx context.Context) error {
+	return checkHarbor(ctx, d.apiClient.v2)
+}
+
+func (d *harborDestination) ChartExists(ctx context.Context, helmChart HelmChart) (bool, error) {
+	ctx, cancel := contextWithTimeout(ctx, apiTimeout)
+	defer cancel()
+
+	// Harbor expects slashes of repository names to be encoded twice.
+	params := artifact.NewGetArtifactParams().
+		WithProjectName(d.m.destinationProject(helmChart)).
+		WithRepositoryName(url.PathEscape(d.m.destinationRepository(helmChart))).
+		WithReference(helmChart.Tag())
+
+	if _, err := d.apiClient.v2.Artifact.GetArtifact(ctx, params); err != nil {
+		var notFound *artifact.GetArtifactNotFound
+		if errors.As(err, &notFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// PushChart pushes the chart file of helmChart with the Pusher, once its
+// destination project created with CreateProjects.
+func (d *harborDestination) PushChart(ctx context.Context, helmChart HelmChart, _ string) error {
+	if d.m.opts.CreateProjects {
+		if err := d.projects.ensure(ctx, d.m.destinationProject(helmChart)); err != nil {
+			return errors.Wrap(err, "Failed to create destination project")
+		}
+	}
+	return d.pushChart(ctx, helmChart)
+}
+
+func (d *harborDestination) VerifyChart(ctx context.Context, helmChart HelmChart, _ string) error {
+	return d.verifyChart(ctx, helmChart)
+}
+
+// CountCharts counts the tags of the chart artifacts of the repositories of the
+// project projectName under the DestPath.
+func (d *harborDestination) CountCharts(ctx context.Context, projectName string) (int, error) {
+	prefix := projectName + "/"
+	if repositoryPrefix := d.m.repositoryPrefix(); repositoryPrefix != "" {
+		prefix += repositoryPrefix + "/"
+	}
+
+	pageSize := int64(defaultPageSize)
+	var count, listedCount int
+	for page := int64(1); ; page++ {
+		pageCtx, cancel := contextWithTimeout(ctx, apiTimeout)
+		res, err := d.apiClient.v2.Repository.ListRepositories(pageCtx, repository.NewListRepositoriesParams().WithProjectName(projectName).WithPage(&page).WithPageSize(&pageSize))
+		cancel()
+		if err != nil {
+			var notFound *repository.ListRepositoriesNotFound
+			if errors.As(err, &notFound) {
+				return 0, nil
+			}
+			return 0, errors.Wrapf(err, "Failed to list repositories page %d", page)
+		}
+
+		for _, repo := range res.Payload {
+			if chartName, ok := strings.CutPrefix(repo.Name, prefix); !ok || strings.Contains(chartName, "/") {
+				continue
+			}
+			helmCharts, err := listRepositoryCharts(ctx, d.apiClient.v2, projectName, strings.TrimPrefix(repo.Name, projectName+"/"))
+			if err != nil {
+				return 0, errors.Wrapf(err, "Failed to list artifacts of repository %s", repo.Name)
+			}
+			count += len(helmCharts)
+		}
+
+		listedCount += len(res.Payload)
+		if isLastPage(len(res.Payload), listedCount, res.XTotalCount) {
+			return count, nil
+		}
+	}
+}
+
+func (d *harborDestination) ChartURL(helmChart HelmChart) string {
+	return d.destinationRepoURL(helmChart)
+}
+
+func (d *harborDestination) Finish(context.Context) error {
+	return nil
+}
+
+func (d *harborDestination) destinationRepoURL(helmChart HelmChart) string {
+	return "oci://" + path.Join(d.registry, d.m.destinationProject(helmChart), d.m.repositoryPrefix())
+}
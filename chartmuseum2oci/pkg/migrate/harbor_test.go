@@ -0,0 +1,89 @@
+package migrate
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestDestinationLowercase(t *testing.T) {
+	helmChart := HelmChart{Name: "MyApp", Project: "TeamA", Version: "1.0.0"}
+	for _, test := range []struct {
+		name           string
+		opts           Options
+		wantProject    string
+		wantRepository string
+		wantRepoURL    string
+	}{
+		{
+			name:           "unmapped",
+			wantProject:    "teama",
+			wantRepository: "myapp",
+			wantRepoURL:    "oci://harbor.example.com/teama",
+		},
+		{
+			name:           "mapped",
+			opts:           Options{ProjectMapping: map[string]string{"TeamA": "TeamB"}},
+			wantProject:    "teamb",
+			wantRepository: "myapp",
+			wantRepoURL:    "oci://harbor.example.com/teamb",
+		},
+		{
+			name:           "destpath",
+			opts:           Options{DestPath: "Charts"},
+			wantProject:    "teama",
+			wantRepository: "charts/myapp",
+			wantRepoURL:    "oci://harbor.example.com/teama/charts",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			m := &Migrator{opts: test.opts}
+			destination := &harborDestination{m: m, registry: "harbor.example.com"}
+
+			if project := m.destinationProject(helmChart); project != test.wantProject {
+				t.Errorf("destination project is %s, want %s", project, test.wantProject)
+			}
+			if repository := m.destinationRepository(helmChart); repository != test.wantRepository {
+				t.Errorf("destination repository is %s, want %s", repository, test.wantRepository)
+			}
+			if repoURL := destination.destinationRepoURL(helmChart); repoURL != test.wantRepoURL {
+				t.Errorf("destination repository URL is %s, want %s", repoURL, test.wantRepoURL)
+			}
+		})
+	}
+}
+
+func TestDestinationPath(t *testing.T) {
+	helmChart := HelmChart{Name: "mychart", Project: "library", Version: "1.0.0"}
+	for _, test := range []struct {
+		destPath       string
+		flatten        bool
+		wantProject    string
+		wantRepository string
+		wantRepoURL    string
+	}{
+		{destPath: "", wantProject: "library", wantRepository: "mychart", wantRepoURL: "oci://harbor.example.com/library"},
+		{destPath: "/sub", wantProject: "library", wantRepository: "sub/mychart", wantRepoURL: "oci://harbor.example.com/library/sub"},
+		{destPath: "sub/", wantProject: "library", wantRepository: "sub/mychart", wantRepoURL: "oci://harbor.example.com/library/sub"},
+		{destPath: "/sub/", wantProject: "library", wantRepository: "sub/mychart", wantRepoURL: "oci://harbor.example.com/library/sub"},
+		{destPath: "//a//b/", wantProject: "library", wantRepository: "a/b/mychart", wantRepoURL: "oci://harbor.example.com/library/a/b"},
+		{destPath: "platform", flatten: true, wantProject: "platform", wantRepository: "mychart", wantRepoURL: "oci://harbor.example.com/platform"},
+		{destPath: "/platform/", flatten: true, wantProject: "platform", wantRepository: "mychart", wantRepoURL: "oci://harbor.example.com/platform"},
+		{destPath: "platform/charts", flatten: true, wantProject: "platform", wantRepository: "charts/mychart", wantRepoURL: "oci://harbor.example.com/platform/charts"},
+		{destPath: "/Platform/Charts/Stable/", flatten: true, wantProject: "platform", wantRepository: "charts/stable/mychart", wantRepoURL: "oci://harbor.example.com/platform/charts/stable"},
+	} {
+		t.Run(fmt.Sprintf("%s flatten %t", test.destPath, test.flatten), func(t *testing.T) {
+			m := &Migrator{opts: Options{DestPath: test.destPath, Flatten: test.flatten}}
+			destination := &harborDestination{m: m, registry: "harbor.example.com"}
+
+			if project := m.destinationProject(helmChart); project != test.wantProject {
+				t.Errorf("destination project is %s, want %s", project, test.wantProject)
+			}
+			if repository := m.destinationRepository(helmChart); repository != test.wantRepository {
+				t.Errorf("destination repository is %s, want %s", repository, test.wantRepository)
+			}
+			if repoURL := destination.destinationRepoURL(helmChart); repoURL != test.wantRepoURL {
+				t.Errorf("destination repository URL is %s, want %s", repoURL, test.wantRepoURL)
+			}
+		})
+	}
+}
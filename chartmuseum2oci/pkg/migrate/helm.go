@@ -0,0 +1,103 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/pkg/errors"
+)
+
+// minHelmVersion is the first helm version supporting OCI registries without
+// HELM_EXPERIMENTAL_OCI, i.e. helm registry login and helm push.
+var minHelmVersion = semver.MustParse("3.8.0")
+
+// checkHelmVersion checks the HelmBinaryPath runs and is at least minHelmVersion.
+func (m *Migrator) checkHelmVersion(ctx context.Context) error {
+	output, err := HelmVersion(ctx, m.opts.HelmBinaryPath)
+	if err != nil {
+		return err
+	}
+
+	version, err := semver.NewVersion(output)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to parse helm version %s", output)
+	}
+	if version.LessThan(minHelmVersion) {
+		return errors.Errorf("helm %s is too old, at least %s is required for OCI registries", version, minHelmVersion)
+	}
+
+	m.logger.Info("Detected helm version", "version", output, "path", m.opts.HelmBinaryPath)
+	return nil
+}
+
+// HelmVersion returns the short version of the helm binary at helmBinaryPath,
+// which looks like v3.12.1+gf32a527.
+func HelmVersion(ctx context.Context, helmBinaryPath string) (string, error) {
+	ctx, cancel := contextWithTimeout(ctx, apiTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, helmBinaryPath, "version", "--short")
+	var stdOut, stdErr bytes.Buffer
+	cmd.Stdout = &stdOut
+	cmd.Stderr = &stdErr
+
+	if err := cmd.Run(); err != nil {
+		return "", errors.Wrapf(err, "Failed to execute helm version: %s", stdErr.String())
+	}
+	return strings.TrimSpace(stdOut.String()), nil
+}
+
+func (m *Migrator) helmLogin(ctx context.Context, registry, username, password string) error {
+	ctx, cancel := contextWithTimeout(ctx, m.opts.LoginTimeout)
+	defer cancel()
+
+	// The password goes through stdin to not be exposed in the process list.
+	// No shell is involved, robot account names such as robot$project+name are
+	// passed as they are.
+	args := []string{"registry", "login", "--username", username, "--password-stdin", registry}
+	args = append(args, m.helmTLSArgs("--insecure")...)
+
+	cmd := m.newHelmCommand(ctx, args...)
+	cmd.Stdin = strings.NewReader(password)
+	var stdErr bytes.Buffer
+	cmd.Stderr = &stdErr
+
+	if err := cmd.Run(); err != nil {
+		return m.redactError(errors.Wrapf(err, "Failed to execute helm login: %s", stdErr.String()))
+	}
+	return nil
+}
+
+func (d *harborDestination) helmPushArgs(helmChart HelmChart) []string {
+	args := []string{"push", d.m.chartFilePath(helmChart), d.destinationRepoURL(helmChart)}
+	return append(args, d.m.helmTLSArgs("--insecure-skip-tls-verify")...)
+}
+
+func (d *harborDestination) pushChartToDestination(ctx context.Context, helmChart HelmChart) error {
+	cmd := d.m.newHelmCommand(ctx, d.helmPushArgs(helmChart)...)
+
+	var stdErr bytes.Buffer
+	cmd.Stderr = &stdErr
+
+	if err := cmd.Run(); err != nil {
+		err = d.m.redactError(errors.Wrapf(err, "Failed to execute helm push: %s", stdErr.String()))
+		if isRetryableHelmOutput(stdErr.String()) {
+			return retryable(err)
+		}
+		return err
+	}
+	return nil
+}
+
+// newHelmCommand returns a helm command going through the ProxyURL if any.
+func (m *Migrator) newHelmCommand(ctx context.Context, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, m.opts.HelmBinaryPath, args...)
+	if m.opts.ProxyURL != "" {
+		cmd.Env = append(os.Environ(), "HTTPS_PROXY="+m.opts.ProxyURL, "HTTP_PROXY="+m.opts.ProxyURL)
+	}
+	return cmd
+}
@@ -0,0 +1,69 @@
+package migrate
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const robotUsername = "robot$project+name"
+
+func TestHelmLoginRobotAccount(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake helm binary is a shell script")
+	}
+
+	dir := t.TempDir()
+	helmBinaryPath := filepath.Join(dir, "helm")
+	script := "#!/bin/sh\nfor arg in \"$@\"; do echo \"$arg\"; done > \"" + dir + "/args\"\ncat > \"" + dir + "/stdin\"\n"
+	if err := os.WriteFile(helmBinaryPath, []byte(script), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &Migrator{opts: Options{HelmBinaryPath: helmBinaryPath}}
+	if err := m.helmLogin(context.Background(), "harbor.example.com", robotUsername, "secret$password"); err != nil {
+		t.Fatal(err)
+	}
+
+	args, err := os.ReadFile(filepath.Join(dir, "args"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"registry", "login", "--username", robotUsername, "--password-stdin", "harbor.example.com"}
+	if got := strings.Split(strings.TrimSuffix(string(args), "\n"), "\n"); !slices.Equal(got, want) {
+		t.Errorf("helm was run with %q, want %q", got, want)
+	}
+	stdin, err := os.ReadFile(filepath.Join(dir, "stdin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(stdin) != "secret$password" {
+		t.Errorf("helm read password %q from stdin, want %q", stdin, "secret$password")
+	}
+}
+
+func TestHarborClientRobotAccount(t *testing.T) {
+	var username string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, _, _ = r.BasicAuth()
+		writeTestJSON(w, []any{})
+	}))
+	defer server.Close()
+
+	apiClient, err := newHarborClient(server.URL, robotUsername, "secret", "", http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listProjects(context.Background(), apiClient.v2); err != nil {
+		t.Fatal(err)
+	}
+	if username != robotUsername {
+		t.Errorf("Harbor received username %q, want %q", username, robotUsername)
+	}
+}
@@ -0,0 +1,1062 @@
+// Package migrate migrates the Helm charts of Harbor ChartMuseum repositories to
+// Harbor OCI repositories.
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"oras.land/oras-go/v2/registry/remote/auth"
+)
+
+const (
+	fileMode        = 0o600
+	dirMode         = 0o700
+	idleConnTimeout = 90 * time.Second
+	apiTimeout      = 30 * time.Second
+	defaultPageSize = 10
+)
+
+// Defaults of the Options of the command line.
+const (
+	DefaultPullTimeout  = 5 * time.Minute
+	DefaultLoginTimeout = 30 * time.Second
+	DefaultMaxRetries   = 3
+)
+
+// Values of Options.Pusher.
+const (
+	PusherHelm = "helm"
+	PusherOCI  = "oci"
+)
+
+// HarborOptions are the URL and credentials of a Harbor, either a username and
+// password or a bearer Token.
+type HarborOptions struct {
+	URL      string
+	Username string
+	Password string
+	Token    string
+}
+
+// Options configures a Migrator, each of them matching the command line flag of
+// the same name.
+type Options struct {
+	// SourceType is the type of the source built from the Source* options,
+	// SourceTypeHarbor by default. It is ignored when Source is set.
+	SourceType string
+	// SourceAPI is the API the Helm charts of a Harbor source are listed with,
+	// SourceAPIChartRepo for its ChartMuseum by default, or SourceAPIArtifacts
+	// for its chart artifacts, which are then pulled from its OCI registry.
+	SourceAPI string
+	// Source is the source of the Helm charts, overriding the Source* options.
+	Source         ChartSource
+	SourceURL      string
+	SourceUsername string
+	SourcePassword string
+	// SourceToken is a bearer token authenticating to the source instead of
+	// the SourceUsername and SourcePassword, e.g. with SSO.
+	SourceToken string
+	// SourceTokenRefresher returns a new SourceToken once the source rejects
+	// the current one, e.g. as it expired, nil meaning it is not refreshed.
+	SourceTokenRefresher func(ctx context.Context) (string, error)
+
+	// DestinationType is the type of the destination built from the
+	// Destination* options, DestinationTypeHarbor by default. It is ignored
+	// when Destination is set.
+	DestinationType string
+	// Destination is where the Helm charts are pushed, overriding the
+	// Destination* options.
+	Destination         ChartDestination
+	DestinationURL      string
+	DestinationUsername string
+	DestinationPassword string
+	// DestinationToken is a bearer token authenticating to the destination
+	// instead of the DestinationUsername and DestinationPassword, requiring the
+	// PusherOCI as helm cannot log in with it.
+	DestinationToken string
+	// Mirrors are other Harbor destinations every Helm chart is also pushed to,
+	// with the same DestPath and Pusher.
+	Mirrors []HarborOptions
+	// DestPath is the subpath of the destination repositories within their
+	// project, or the directory of a DestinationTypeDir destination.
+	DestPath string
+	// Flatten pushes the Helm charts of all the source projects under the
+	// DestPath, its first segment being the project of a Harbor destination,
+	// ignoring the source projects and the ProjectMapping. The Helm charts of a
+	// DestinationTypeDir destination are then all written in its directory.
+	Flatten bool
+
+	// Projects are the source projects to migrate, all of them when empty.
+	Projects        []string
+	ExcludeProjects []string
+	// ProjectMapping maps source projects to destination projects, the
+	// destination project of the unmapped ones having the same name.
+	ProjectMapping map[string]string
+
+	// Concurrency is the number of Helm charts migrated in parallel, at least 1.
+	Concurrency int
+	// PerProjectConcurrency is the number of Helm charts of a same destination
+	// project migrated in parallel, 0 meaning up to the Concurrency.
+	PerProjectConcurrency int
+	// PullTimeout and LoginTimeout are the timeouts of a Helm chart download and
+	// of a helm registry login, 0 meaning no timeout.
+	PullTimeout  time.Duration
+	LoginTimeout time.Duration
+	// ChartTimeout is the maximum duration of the whole migration of a Helm
+	// chart, its retries included, after which its downloads and helm commands
+	// are cancelled and it fails, 0 meaning no timeout.
+	ChartTimeout time.Duration
+	MaxRetries   int
+	Overwrite    bool
+	DryRun       bool
+
+	InsecureSkipTLSVerify bool
+	CACertFiles           []string
+	ClientCertFile        string
+	ClientKeyFile         string
+	ProxyURL              string
+	// UserAgent is the User-Agent header of the requests to the source and
+	// destinations, except the ones of helm with the helm pusher, the one of Go
+	// when empty.
+	UserAgent string
+	// SourceHeaders are added to the requests to the source, e.g. for a gateway
+	// in front of it, without replacing the headers they already have such as
+	// their Authorization.
+	SourceHeaders http.Header
+
+	// WorkDir is the directory the Helm charts are downloaded into, a temporary
+	// directory removed once migrated when empty.
+	WorkDir    string
+	KeepCharts bool
+	// MinFreeSpace is the number of bytes which must remain free on the
+	// filesystem of the WorkDir, checked before the migration and before each
+	// download of a known size.
+	MinFreeSpace int64
+	// MaxChartSize is the size in bytes above which the Helm charts fail to
+	// migrate instead of being downloaded, 0 meaning no limit.
+	MaxChartSize int64
+	// MaxBandwidth is the maximum aggregate throughput of the downloads from the
+	// source of all the workers, in bytes per second, 0 meaning no limit.
+	MaxBandwidth int64
+
+	CreateProjects       bool
+	CreatePublicProjects bool
+
+	// VersionConstraint is the SemVer constraint of the versions to migrate, nil
+	// meaning all of them.
+	VersionConstraint      *semver.Constraints
+	IncludeInvalidVersions bool
+	NameFilters            []string
+	NameRegexps            []string
+	CaseSensitiveNames     bool
+	// NameRewrites rename the Helm charts in the destination, each one
+	// applying to the name rewritten by the previous ones.
+	NameRewrites []NameRewrite
+	// LatestVersions is the number of highest versions of each Helm chart to
+	// migrate, 0 meaning all of them.
+	LatestVersions  int
+	SkipPrereleases bool
+
+	FailFast               bool
+	MaxConsecutiveFailures int
+	SkipVerifyDigest       bool
+	ValidateCharts         bool
+	Verify                 bool
+	// ImageRewrites maps image registry prefixes, e.g. old.registry or
+	// old.registry/team, to the ones replacing them in the values.yaml of the
+	// Helm charts and of their subcharts, which are pushed with the same
+	// version.
+	ImageRewrites map[string]string
+	// DependencyRewrites maps repository URLs of the dependencies of the Helm
+	// charts, in their Chart.yaml and Chart.lock, to the ones replacing them,
+	// e.g. oci://harbor.example.com/library.
+	DependencyRewrites map[string]string
+	// RewriteDependencies also rewrites the dependencies on the source
+	// repository of each Helm chart to its destination OCI repository, when
+	// the destination is a Harbor.
+	RewriteDependencies bool
+	// DeleteSource deletes each Helm chart version from the source, which must
+	// be a DeletingChartSource, once migrated to every destination, never when
+	// it was skipped or failed.
+	DeleteSource bool
+	// AnnotateMigration records in the manifest of each Helm chart pushed with
+	// PusherOCI the URL it was migrated from and when, which helm push cannot.
+	AnnotateMigration bool
+
+	// Pusher is the way of pushing the Helm charts, PusherHelm by default.
+	Pusher         string
+	HelmBinaryPath string
+
+	// ListOnly builds a Migrator without destination, which only lists the
+	// source Helm charts with ListCharts, ignoring the Destination* options.
+	ListOnly bool
+
+	// Logger logs the migration, slog.Default() when nil.
+	Logger *slog.Logger
+	// TracerProvider provides the tracer of the spans of the migration, of its
+	// Helm charts and of their pull, push and verify steps, the global one when
+	// nil.
+	TracerProvider trace.TracerProvider
+	// OnStart is called with each Helm chart a worker starts to migrate, and
+	// OnResult with its result once processed, from the goroutine processing
+	// it.
+	OnStart  func(HelmChart)
+	OnResult func(ChartResult)
+}
+
+// Migrator migrates Helm charts from a ChartSource, a Harbor by default, to a
+// ChartDestination, a Harbor by default.
+type Migrator struct {
+	opts   Options
+	logger *slog.Logger
+	tracer trace.Tracer
+
+	// sourceRegistry is the host[:port] of the Harbor source helm logs in to,
+	// empty for other sources.
+	sourceRegistry string
+	nameMatchers   []func(name string) bool
+	nameRewrites   []nameRewrite
+	imageRewrites  []imageRewrite
+	// bandwidth limits the downloads to the MaxBandwidth, nil without limit.
+	bandwidth *bandwidthLimiter
+	// passwords are the passwords redacted from the errors.
+	passwords []string
+	// helmCAFile is the CA certificate bundle given to helm, gathering all the
+	// CACertFiles as helm accepts a single --ca-file.
+	helmCAFile string
+	// caBundleFile is the helmCAFile written by the Migrator, removed by Close.
+	caBundleFile string
+
+	httpClient   *http.Client
+	source       ChartSource
+	destinations []ChartDestination
+	ociAuthCache auth.Cache
+	workDir      string
+}
+
+// New returns a Migrator configured by opts.
+func New(opts Options) (*Migrator, error) {
+	m := &Migrator{
+		opts:         opts,
+		logger:       opts.Logger,
+		passwords:    []string{opts.SourcePassword, opts.DestinationPassword, opts.SourceToken, opts.DestinationToken},
+		ociAuthCache: auth.NewCache(),
+	}
+	if m.logger == nil {
+		m.logger = slog.Default()
+	}
+	tracerProvider := opts.TracerProvider
+	if tracerProvider == nil {
+		tracerProvider = otel.GetTracerProvider()
+	}
+	m.tracer = tracerProvider.Tracer(tracerName)
+	if m.opts.Concurrency < 1 {
+		m.opts.Concurrency = 1
+	}
+	if m.opts.HelmBinaryPath == "" {
+		m.opts.HelmBinaryPath = "helm"
+	}
+	switch m.opts.Pusher {
+	case "":
+		m.opts.Pusher = PusherHelm
+	case PusherHelm, PusherOCI:
+	default:
+		return nil, errors.Errorf("Invalid pusher %s, must be %s or %s", m.opts.Pusher, PusherHelm, PusherOCI)
+	}
+
+	if opts.SourceToken != "" && (opts.SourceUsername != "" || opts.SourcePassword != "") {
+		return nil, errors.New("Source token and username or password are mutually exclusive")
+	}
+
+	var err error
+	if m.nameMatchers, err = compileNameFilters(opts.NameFilters, opts.NameRegexps, opts.CaseSensitiveNames); err != nil {
+		return nil, err
+	}
+
+	if m.nameRewrites, err = compileNameRewrites(opts.NameRewrites); err != nil {
+		return nil, err
+	}
+	m.imageRewrites = newImageRewrites(opts.ImageRewrites)
+	if opts.MaxBandwidth > 0 {
+		m.bandwidth = newBandwidthLimiter(opts.MaxBandwidth)
+	}
+
+	transport, err := m.newTransport()
+	if err != nil {
+		m.Close()
+		return nil, err
+	}
+	m.httpClient = &http.Client{Transport: transport}
+
+	if m.source = opts.Source; m.source == nil {
+		if m.source, err = m.newSource(); err != nil {
+			m.Close()
+			return nil, err
+		}
+	}
+	if _, ok := m.source.(DeletingChartSource); opts.DeleteSource && !ok {
+		m.Close()
+		return nil, errors.New("Source does not support deleting Helm charts")
+	}
+	if !opts.ListOnly {
+		if m.destinations, err = m.newDestinations(); err != nil {
+			m.Close()
+			return nil, err
+		}
+		if opts.AnnotateMigration && m.opts.Pusher == PusherHelm && m.hasHarborDestination() {
+			m.logger.Warn("Not annotating the migrated Helm charts, helm push cannot add annotations, use the oci pusher")
+		}
+	}
+
+	return m, nil
+}
+
+// Close removes the files the Migrator wrote outside of its work directory, once
+// done with it.
+func (m *Migrator) Close() error {
+	if m.caBundleFile == "" {
+		return nil
+	}
+	if err := os.Remove(m.caBundleFile); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "Failed to remove CA certificate bundle")
+	}
+	m.caBundleFile = ""
+	return nil
+}
+
+// newTransport returns the HTTP transport shared by all the requests to Harbor,
+// keeping enough idle connections for every worker to reuse them.
+func (m *Migrator) newTransport() (http.RoundTripper, error) {
+	tlsConfig, err := m.newTLSConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to configure TLS")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = m.opts.Concurrency
+	transport.IdleConnTimeout = idleConnTimeout
+	transport.TLSClientConfig = tlsConfig
+	if m.opts.ProxyURL != "" {
+		u, err := url.Parse(m.opts.ProxyURL)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to parse proxy URL")
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+
+	if m.opts.UserAgent != "" {
+		return &userAgentTransport{userAgent: m.opts.UserAgent, transport: transport}, nil
+	}
+	return transport, nil
+}
+
+// headerTransport adds the headers to the requests sent through transport,
+// keeping the ones they already have.
+type headerTransport struct {
+	header    http.Header
+	transport http.RoundTripper
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for key, values := range t.header {
+		if _, ok := req.Header[key]; !ok {
+			req.Header[key] = values
+		}
+	}
+	return t.transport.RoundTrip(req)
+}
+
+// sourceHTTPClient returns the HTTP client of the requests to the source,
+// adding the SourceHeaders to them.
+func (m *Migrator) sourceHTTPClient() *http.Client {
+	if len(m.opts.SourceHeaders) == 0 {
+		return m.httpClient
+	}
+	return &http.Client{Transport: &headerTransport{header: m.opts.SourceHeaders, transport: m.httpClient.Transport}}
+}
+
+// userAgentTransport sets the User-Agent header of the requests sent through
+// transport, replacing the one of the clients, e.g. oras-go.
+type userAgentTransport struct {
+	userAgent string
+	transport http.RoundTripper
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.userAgent)
+	return t.transport.RoundTrip(req)
+}
+
+// newSource returns the ChartSource of the SourceType built from the Source*
+// options.
+func (m *Migrator) newSource() (ChartSource, error) {
+	httpClient := m.sourceHTTPClient()
+	switch m.opts.SourceType {
+	case "", SourceTypeHarbor:
+		sourceURL, sourceRegistry, err := NormalizeHarborURL(m.opts.SourceURL)
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid source URL")
+		}
+		// The API requests are authenticated by the credentials transport, with
+		// the token once refreshed.
+		credentials := newSourceCredentials(m.opts.SourceUsername, m.opts.SourcePassword, m.opts.SourceToken, m.opts.SourceTokenRefresher)
+		apiClient, err := newHarborClient(sourceURL, m.opts.SourceUsername, m.opts.SourcePassword, m.opts.SourceToken, &credentialsTransport{credentials: credentials, transport: httpClient.Transport})
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to create source Harbor client")
+		}
+		m.sourceRegistry = sourceRegistry
+
+		switch m.opts.SourceAPI {
+		case "", SourceAPIChartRepo:
+			// The ChartMuseum of the Harbor, below.
+		case SourceAPIArtifacts:
+			return &harborArtifactSource{
+				harborURL:         sourceURL,
+				registry:          sourceRegistry,
+				sourceCredentials: credentials,
+				projects:          m.opts.Projects,
+				excludeProjects:   m.opts.ExcludeProjects,
+				apiClient:         apiClient,
+				projectList:       newProjectList(apiClient.v2),
+				httpClient:        httpClient,
+				// The source credentials may differ from the destination ones of
+				// the same registry.
+				authCache: auth.NewCache(),
+			}, nil
+		default:
+			return nil, errors.Errorf("Invalid source API %s, must be %s or %s", m.opts.SourceAPI, SourceAPIChartRepo, SourceAPIArtifacts)
+		}
+
+		return &harborSource{
+			harborURL:         sourceURL,
+			sourceCredentials: credentials,
+			projects:          m.opts.Projects,
+			excludeProjects:   m.opts.ExcludeProjects,
+			apiClient:         apiClient,
+			projectList:       newProjectList(apiClient.v2),
+			httpClient:        httpClient,
+		}, nil
+	case SourceTypeChartMuseum:
+		sourceURL, err := NormalizeChartMuseumURL(m.opts.SourceURL)
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid source URL")
+		}
+
+		return &chartMuseumSource{
+			baseURL:           sourceURL,
+			sourceCredentials: newSourceCredentials(m.opts.SourceUsername, m.opts.SourcePassword, m.opts.SourceToken, m.opts.SourceTokenRefresher),
+			projects:          m.opts.Projects,
+			excludeProjects:   m.opts.ExcludeProjects,
+			httpClient:        httpClient,
+		}, nil
+	default:
+		return nil, errors.Errorf("Invalid source type %s, must be %s or %s", m.opts.SourceType, SourceTypeHarbor, SourceTypeChartMuseum)
+	}
+}
+
+// newDestinations returns the Destination, or the one built from the
+// Destination* options, followed by the Mirrors.
+func (m *Migrator) newDestinations() ([]ChartDestination, error) {
+	destination := m.opts.Destination
+	if destination == nil {
+		var err error
+		if destination, err = m.newDestination(); err != nil {
+			return nil, err
+		}
+	}
+
+	destinations := []ChartDestination{destination}
+	for _, mirror := range m.opts.Mirrors {
+		destination, err := m.newHarborDestination(mirror)
+		if err != nil {
+			return nil, err
+		}
+		destinations = append(destinations, destination)
+		m.passwords = append(m.passwords, mirror.Password, mirror.Token)
+	}
+	return destinations, nil
+}
+
+// newDestination returns the ChartDestination of the DestinationType built from
+// the Destination* options.
+func (m *Migrator) newDestination() (ChartDestination, error) {
+	switch m.opts.DestinationType {
+	case "", DestinationTypeHarbor:
+		return m.newHarborDestination(HarborOptions{
+			URL:      m.opts.DestinationURL,
+			Username: m.opts.DestinationUsername,
+			Password: m.opts.DestinationPassword,
+			Token:    m.opts.DestinationToken,
+		})
+	case DestinationTypeDir:
+		if m.opts.DestPath == "" {
+			return nil, errors.New("Missing destination path of the dir destination")
+		}
+		return newDirDestination(m.opts.DestPath, m.destinationProject, m.logger), nil
+	default:
+		return nil, errors.Errorf("Invalid destination type %s, must be %s or %s", m.opts.DestinationType, DestinationTypeHarbor, DestinationTypeDir)
+	}
+}
+
+func (m *Migrator) newHarborDestination(harbor HarborOptions) (*harborDestination, error) {
+	harborURL, registry, err := NormalizeHarborURL(harbor.URL)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid destination URL")
+	}
+	if harbor.Token != "" {
+		if harbor.Username != "" || harbor.Password != "" {
+			return nil, errors.Errorf("Destination %s token and username or password are mutually exclusive", registry)
+		}
+		if m.opts.Pusher == PusherHelm {
+			return nil, errors.Errorf("Destination %s token requires the %s pusher, helm cannot log in with it", registry, PusherOCI)
+		}
+	}
+	apiClient, err := newHarborClient(harborURL, harbor.Username, harbor.Password, harbor.Token, m.httpClient.Transport)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create destination Harbor client")
+	}
+
+	return &harborDestination{
+		m:         m,
+		url:       harborURL,
+		registry:  registry,
+		username:  harbor.Username,
+		password:  harbor.Password,
+		token:     harbor.Token,
+		apiClient: apiClient,
+		projects:  newDestinationProjects(apiClient.v2, m.opts.CreatePublicProjects, m.logger),
+	}, nil
+}
+
+// Connect checks the source and destinations are reachable and accept their
+// credentials, then logs helm in to them when pushing with helm.
+func (m *Migrator) Connect(ctx context.Context) error {
+	if err := m.source.Check(ctx); err != nil {
+		return errors.Wrap(err, "Failed to check source")
+	}
+	for _, destination := range m.destinations {
+		if err := destination.Check(ctx); err != nil {
+			return errors.Wrapf(err, "Failed to check destination %s", destination)
+		}
+	}
+
+	// Charts are pulled over HTTP, helm is only needed to push them to Harbor.
+	if m.opts.DryRun || m.opts.Pusher != PusherHelm || !m.hasHarborDestination() {
+		return nil
+	}
+
+	if err := m.checkHelmVersion(ctx); err != nil {
+		return errors.Wrap(err, "Unsupported helm binary")
+	}
+	// helm cannot log in with a token, which pulling over HTTP does not need.
+	if m.sourceRegistry != "" && m.opts.SourceToken == "" {
+		if err := m.helmLogin(ctx, m.sourceRegistry, m.opts.SourceUsername, m.opts.SourcePassword); err != nil {
+			return errors.Wrap(err, "Failed to login to source Harbor")
+		}
+	}
+	for _, destination := range m.destinations {
+		if harbor, ok := destination.(*harborDestination); ok {
+			if err := m.helmLogin(ctx, harbor.registry, harbor.username, harbor.password); err != nil {
+				return errors.Wrapf(err, "Failed to login to destination Harbor %s", harbor)
+			}
+		}
+	}
+	return nil
+}
+
+// CheckDestinationProjects checks every Harbor destination has the destination
+// projects of helmCharts, once mapped, returning an error listing the missing
+// ones otherwise.
+func (m *Migrator) CheckDestinationProjects(ctx context.Context, helmCharts []HelmChart) error {
+	projectNames := make([]string, 0)
+	for _, helmChart := range helmCharts {
+		if projectName := m.destinationProject(helmChart); !slices.Contains(projectNames, projectName) {
+			projectNames = append(projectNames, projectName)
+		}
+	}
+	slices.Sort(projectNames)
+
+	for _, destination := range m.destinations {
+		harbor, ok := destination.(*harborDestination)
+		if !ok {
+			continue
+		}
+		missing, err := harbor.projects.missing(ctx, projectNames)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to check projects of destination %s", harbor)
+		}
+		if len(missing) > 0 {
+			return errors.Errorf("Destination %s is missing the projects %s", harbor, strings.Join(missing, ", "))
+		}
+	}
+	return nil
+}
+
+func (m *Migrator) hasHarborDestination() bool {
+	for _, destination := range m.destinations {
+		if _, ok := destination.(*harborDestination); ok {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	errFailFast                   = errors.New("a Helm chart failed to migrate with fail fast")
+	errTooManyConsecutiveFailures = errors.New("too many Helm charts failed in a row, the destination may be unavailable")
+	errChartTimeout               = errors.New("chart timeout exceeded")
+)
+
+// Summary gathers the results of the Helm charts processed by a migration.
+type Summary struct {
+	Processed int
+	Failed    int
+	Results   []ChartResult
+	// AbortCause is the reason the migration stopped before processing all the
+	// Helm charts, nil if it did not or was cancelled.
+	AbortCause error
+}
+
+// Migrate migrates the given Helm charts using a pool of Concurrency workers,
+// at most PerProjectConcurrency of them migrating charts of a same project.
+// Once ctx is cancelled, no more charts are scheduled and the in-flight ones are
+// cancelled. With FailFast, no more charts are scheduled once one failed, nor
+// once MaxConsecutiveFailures failed in a row, the in-flight ones being completed.
+func (m *Migrator) Migrate(ctx context.Context, helmCharts []HelmChart) (Summary, error) {
+	if len(m.destinations) == 0 {
+		return Summary{}, errors.New("No destination to migrate to, the migrator only lists Helm charts")
+	}
+
+	removeWorkDir, err := m.prepareWorkDir()
+	if err != nil {
+		return Summary{}, errors.Wrap(err, "Failed to create work directory")
+	}
+	defer removeWorkDir()
+
+	if !m.opts.DryRun {
+		if err := m.checkFreeSpace(0); err != nil {
+			return Summary{}, err
+		}
+	}
+
+	ctx, span := m.tracer.Start(ctx, "migrate", trace.WithAttributes(attribute.Int("charts", len(helmCharts))))
+	var summary Summary
+	defer func() {
+		endSpan(span, summary.AbortCause, attribute.Int("charts.processed", summary.Processed), attribute.Int("charts.failed", summary.Failed))
+	}()
+	var summaryMutex sync.Mutex
+	var consecutiveFailures int
+	var wg sync.WaitGroup
+	helmChartsChan := make(chan HelmChart)
+	scheduleCtx, abort := context.WithCancelCause(ctx)
+	defer abort(nil)
+	var semaphores *projectSemaphores
+	if m.opts.PerProjectConcurrency > 0 && m.opts.PerProjectConcurrency < m.opts.Concurrency {
+		semaphores = newProjectSemaphores(m.opts.PerProjectConcurrency)
+	}
+
+	for i := 0; i < m.opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for helmChart := range helmChartsChan {
+				if m.opts.OnStart != nil {
+					m.opts.OnStart(helmChart)
+				}
+				start := time.Now()
+				chartCtx, chartSpan := m.startChartSpan(ctx, helmChart)
+				chartCtx, cancelChart := m.chartContext(chartCtx)
+				status, chartSize, destinations, err := m.migrateChartRecovering(chartCtx, helmChart)
+				if err != nil && errors.Is(context.Cause(chartCtx), errChartTimeout) {
+					err = errors.Wrapf(err, "Chart timeout of %s exceeded", m.opts.ChartTimeout)
+				}
+				cancelChart()
+				if semaphores != nil {
+					semaphores.release(m.destinationProject(helmChart))
+				}
+				endSpan(chartSpan, err, statusKey.String(string(status)), bytesKey.Int64(chartSize))
+				duration := time.Since(start)
+				switch {
+				case err != nil:
+					m.logger.Error("Failed to migrate Helm chart", chartAttrs(helmChart, "duration", duration, "error", err)...)
+				case status == StatusMigrated:
+					m.logger.Info("Migrated Helm chart", chartAttrs(helmChart, "duration", duration, "bytes", chartSize)...)
+				}
+				result := newChartResult(helmChart, status, chartSize, destinations, err, duration)
+
+				summaryMutex.Lock()
+				summary.Processed++
+				if status == StatusFailed {
+					summary.Failed++
+					consecutiveFailures++
+					if m.opts.FailFast {
+						abort(errFailFast)
+					}
+					if errors.Is(err, errNotEnoughDiskSpace) {
+						abort(err)
+					}
+					if m.opts.MaxConsecutiveFailures > 0 && consecutiveFailures >= m.opts.MaxConsecutiveFailures {
+						abort(errTooManyConsecutiveFailures)
+					}
+				} else {
+					consecutiveFailures = 0
+				}
+				summary.Results = append(summary.Results, result)
+				summaryMutex.Unlock()
+
+				if m.opts.OnResult != nil {
+					m.opts.OnResult(result)
+				}
+			}
+		}()
+	}
+
+	if semaphores != nil {
+		semaphores.scheduleCharts(scheduleCtx, helmCharts, helmChartsChan, m.destinationProject)
+	} else {
+	schedule:
+		for _, helmChart := range helmCharts {
+			select {
+			case helmChartsChan <- helmChart:
+			case <-scheduleCtx.Done():
+				break schedule
+			}
+		}
+	}
+	close(helmChartsChan)
+	wg.Wait()
+
+	if ctx.Err() == nil && scheduleCtx.Err() != nil {
+		summary.AbortCause = context.Cause(scheduleCtx)
+	}
+
+	// The pushed charts are completed even when interrupted.
+	if !m.opts.DryRun {
+		for _, destination := range m.destinations {
+			if err := destination.Finish(context.WithoutCancel(ctx)); err != nil {
+				return summary, errors.Wrapf(err, "Failed to finish migration to destination %s", destination)
+			}
+		}
+	}
+
+	return summary, nil
+}
+
+// prepareWorkDir creates the directory the Helm charts are downloaded into and
+// returns the function removing it, which keeps a WorkDir or kept charts.
+func (m *Migrator) prepareWorkDir() (func(), error) {
+	if m.opts.WorkDir != "" {
+		m.workDir = m.opts.WorkDir
+		return func() {}, os.MkdirAll(m.workDir, dirMode)
+	}
+
+	tmpDir, err := os.MkdirTemp("", "chartmuseum2oci-")
+	if err != nil {
+		return nil, err
+	}
+	m.workDir = tmpDir
+
+	if m.opts.KeepCharts {
+		m.logger.Info("Downloaded Helm charts are kept", "dir", m.workDir)
+		return func() {}, nil
+	}
+
+	return func() {
+		if err := os.RemoveAll(m.workDir); err != nil {
+			m.logger.Error("Failed to remove work directory", "error", err)
+		}
+	}, nil
+}
+
+// chartContext returns the context of the migration of a Helm chart, cancelled
+// with errChartTimeout once the ChartTimeout is exceeded.
+func (m *Migrator) chartContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if m.opts.ChartTimeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeoutCause(ctx, m.opts.ChartTimeout, errChartTimeout)
+}
+
+// migrateChartRecovering migrates helmChart with migrateChart, turning a panic
+// into a failure of helmChart so that the other ones keep migrating.
+func (m *Migrator) migrateChartRecovering(ctx context.Context, helmChart HelmChart) (status ChartStatus, chartSize int64, destinations []DestinationResult, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			m.logger.Debug("Recovered from panic migrating Helm chart", chartAttrs(helmChart, "panic", r, "stack", string(debug.Stack()))...)
+			status, err = StatusFailed, errors.Errorf("panic: %v", r)
+		}
+	}()
+	return m.migrateChart(ctx, helmChart)
+}
+
+func (m *Migrator) migrateChart(ctx context.Context, helmChart HelmChart) (ChartStatus, int64, []DestinationResult, error) {
+	if len(m.nameRewrites) > 0 {
+		var err error
+		if helmChart.NewName, err = m.rewriteName(helmChart.Name); err != nil {
+			return StatusFailed, 0, nil, err
+		}
+	}
+
+	if m.opts.DryRun {
+		m.logger.Info("[dry-run] Would pull Helm chart", chartAttrs(helmChart, "url", m.source.ChartURL(helmChart))...)
+		for _, destination := range m.destinations {
+			harbor, ok := destination.(*harborDestination)
+			if m.opts.Pusher == PusherOCI || !ok {
+				m.logger.Info("[dry-run] Would push Helm chart", chartAttrs(helmChart, "url", destination.ChartURL(helmChart))...)
+			} else {
+				m.logger.Info("[dry-run] Would push Helm chart", chartAttrs(helmChart, "url", harbor.destinationRepoURL(helmChart), "command", m.opts.HelmBinaryPath+" "+strings.Join(harbor.helmPushArgs(helmChart), " "))...)
+			}
+		}
+		if m.opts.DeleteSource {
+			m.logger.Info("[dry-run] Would delete Helm chart from source once migrated", chartAttrs(helmChart)...)
+		}
+		return StatusSkipped, 0, nil, nil
+	}
+
+	if err := validateTag(helmChart.Tag()); err != nil {
+		return StatusFailed, 0, nil, err
+	}
+	if tag := helmChart.Tag(); tag != helmChart.Version {
+		m.logger.Info("Helm chart version is tagged differently in destination", chartAttrs(helmChart, "tag", tag)...)
+	}
+
+	outcomes := make([]destinationOutcome, len(m.destinations))
+	pending := make([]*destinationOutcome, 0, len(m.destinations))
+	for i, destination := range m.destinations {
+		outcomes[i].destination = destination
+		if m.opts.Overwrite {
+			pending = append(pending, &outcomes[i])
+			continue
+		}
+
+		exists, err := destination.ChartExists(ctx, helmChart)
+		switch {
+		case err != nil:
+			outcomes[i].fail(errors.Wrap(err, "Failed to check chart presence in destination"))
+		case exists:
+			m.logger.Info("Skipping Helm chart, already present in destination", m.destinationAttrs(helmChart, destination)...)
+			outcomes[i].status = StatusSkipped
+		default:
+			pending = append(pending, &outcomes[i])
+		}
+	}
+	if len(pending) == 0 {
+		return m.chartOutcome(outcomes, 0)
+	}
+
+	pullCtx, pullSpan := m.tracer.Start(ctx, "pull")
+	pull := func() error { return m.pullChartFromSource(pullCtx, helmChart) }
+	if err := m.withRetry(pullCtx, "pull", helmChart, pull); err != nil {
+		endSpan(pullSpan, err)
+		return m.failChart(outcomes, pending, 0, errors.Wrap(err, "Failed to pull chart from source"))
+	}
+
+	var chartSize int64
+	if info, err := os.Stat(m.chartFilePath(helmChart)); err == nil {
+		chartSize = info.Size()
+	}
+	endSpan(pullSpan, nil, bytesKey.Int64(chartSize))
+
+	if !m.opts.KeepCharts {
+		defer func() {
+			if err := m.removeChartFile(helmChart); err != nil {
+				m.logger.Error("Failed to remove file of Helm chart", chartAttrs(helmChart, "error", err)...)
+			}
+		}()
+	}
+
+	pullProvenance := func() error { return m.pullProvenanceFromSource(ctx, helmChart) }
+	if err := m.withRetry(ctx, "provenance pull", helmChart, pullProvenance); err != nil {
+		return m.failChart(outcomes, pending, chartSize, errors.Wrap(err, "Failed to pull chart provenance from source"))
+	}
+
+	if m.opts.ValidateCharts {
+		if err := validateChart(m.chartFilePath(helmChart), helmChart); err != nil {
+			return m.failChart(outcomes, pending, chartSize, errors.Wrap(err, "Invalid chart downloaded from source"))
+		}
+	}
+
+	if destinationName := helmChart.DestinationName(); destinationName != helmChart.Name {
+		if strings.ToLower(helmChart.Name) == destinationName {
+			m.logger.Warn("Renaming Helm chart, OCI repository names must be lowercase", chartAttrs(helmChart, "destinationName", destinationName)...)
+		} else {
+			m.logger.Info("Renaming Helm chart as rewritten", chartAttrs(helmChart, "destinationName", destinationName)...)
+		}
+		if err := os.Remove(m.provenanceFilePath(helmChart)); err == nil {
+			m.logger.Warn("Dropping provenance of renamed Helm chart, its signature no longer matches", chartAttrs(helmChart)...)
+		}
+		if err := renameChart(m.chartFilePath(helmChart), destinationName); err != nil {
+			return m.failChart(outcomes, pending, chartSize, errors.Wrap(err, "Failed to rename chart"))
+		}
+	}
+
+	if len(m.imageRewrites) > 0 {
+		rewritten, err := rewriteChartImages(m.chartFilePath(helmChart), m.imageRewrites)
+		if err != nil {
+			return m.failChart(outcomes, pending, chartSize, errors.Wrap(err, "Failed to rewrite image references of chart"))
+		}
+		if rewritten {
+			m.logger.Info("Rewrote image references of Helm chart", chartAttrs(helmChart)...)
+			if err := os.Remove(m.provenanceFilePath(helmChart)); err == nil {
+				m.logger.Warn("Dropping provenance of rewritten Helm chart, its signature no longer matches", chartAttrs(helmChart)...)
+			}
+		}
+	}
+
+	if rewrites := m.dependencyRewrites(helmChart); len(rewrites) > 0 {
+		rewritten, err := rewriteChartDependencies(m.chartFilePath(helmChart), rewrites)
+		if err != nil {
+			return m.failChart(outcomes, pending, chartSize, errors.Wrap(err, "Failed to rewrite dependencies of chart"))
+		}
+		if rewritten {
+			m.logger.Info("Rewrote dependency repositories of Helm chart", chartAttrs(helmChart)...)
+			if err := os.Remove(m.provenanceFilePath(helmChart)); err == nil {
+				m.logger.Warn("Dropping provenance of rewritten Helm chart, its signature no longer matches", chartAttrs(helmChart)...)
+			}
+		}
+	}
+
+	// The chart pulled once is pushed to every destination, whatever the
+	// failures of the other ones.
+	for _, outcome := range pending {
+		outcome.status = StatusMigrated
+		destination := outcome.destination
+
+		pushCtx, pushSpan := m.tracer.Start(ctx, "push", trace.WithAttributes(destinationKey.String(destination.String())))
+		push := func() error { return destination.PushChart(pushCtx, helmChart, m.chartFilePath(helmChart)) }
+		err := m.withRetry(pushCtx, "push", helmChart, push)
+		endSpan(pushSpan, err, bytesKey.Int64(chartSize))
+		if err != nil {
+			outcome.fail(errors.Wrap(err, "Failed to push chart to destination"))
+			continue
+		}
+
+		if m.opts.Verify {
+			verifyCtx, verifySpan := m.tracer.Start(ctx, "verify", trace.WithAttributes(destinationKey.String(destination.String())))
+			verify := func() error { return destination.VerifyChart(verifyCtx, helmChart, m.chartFilePath(helmChart)) }
+			err := m.withRetry(verifyCtx, "verify", helmChart, verify)
+			endSpan(verifySpan, err)
+			if err != nil {
+				outcome.fail(errors.Wrap(err, "Failed to verify chart in destination"))
+			}
+		}
+	}
+
+	status, chartSize, results, err := m.chartOutcome(outcomes, chartSize)
+	if status == StatusMigrated && m.opts.DeleteSource {
+		if err := m.deleteChartFromSource(ctx, helmChart); err != nil {
+			return StatusFailed, chartSize, results, errors.Wrap(err, "Failed to delete chart from source")
+		}
+	}
+	return status, chartSize, results, err
+}
+
+// deleteChartFromSource deletes the migrated helmChart from the source.
+func (m *Migrator) deleteChartFromSource(ctx context.Context, helmChart HelmChart) error {
+	ctx, span := m.tracer.Start(ctx, "delete")
+	source := m.source.(DeletingChartSource)
+	err := m.withRetry(ctx, "delete", helmChart, func() error {
+		return m.withReauthentication(ctx, func() error { return source.DeleteChart(ctx, helmChart) })
+	})
+	endSpan(span, err)
+	if err == nil {
+		m.logger.Info("Deleted Helm chart from source", chartAttrs(helmChart)...)
+	}
+	return err
+}
+
+// destinationOutcome is the outcome of the migration of a Helm chart to one of
+// the destinations.
+type destinationOutcome struct {
+	destination ChartDestination
+	status      ChartStatus
+	err         error
+}
+
+func (o *destinationOutcome) fail(err error) {
+	o.status = StatusFailed
+	o.err = err
+}
+
+// failChart fails the migration of a Helm chart to the pending destinations
+// with err, a failure before any push.
+func (m *Migrator) failChart(outcomes []destinationOutcome, pending []*destinationOutcome, chartSize int64, err error) (ChartStatus, int64, []DestinationResult, error) {
+	for _, outcome := range pending {
+		outcome.fail(err)
+	}
+	status, _, results, _ := m.chartOutcome(outcomes, chartSize)
+	return status, chartSize, results, err
+}
+
+// chartOutcome returns the status of the migration of a Helm chart from its
+// outcomes, failed if it failed for any destination and migrated if it was
+// pushed to any, along with the per destination results when migrating to
+// several of them.
+func (m *Migrator) chartOutcome(outcomes []destinationOutcome, chartSize int64) (ChartStatus, int64, []DestinationResult, error) {
+	status := StatusSkipped
+	errs := make([]string, 0)
+	var err error
+	for _, outcome := range outcomes {
+		switch {
+		case outcome.status == StatusFailed:
+			status = StatusFailed
+			err = outcome.err
+			errs = append(errs, fmt.Sprintf("%s: %s", outcome.destination, outcome.err))
+		case outcome.status == StatusMigrated && status != StatusFailed:
+			status = StatusMigrated
+		}
+	}
+
+	if len(outcomes) == 1 {
+		return status, chartSize, nil, err
+	}
+
+	results := make([]DestinationResult, 0, len(outcomes))
+	for _, outcome := range outcomes {
+		results = append(results, newDestinationResult(outcome.destination, outcome.status, outcome.err))
+	}
+	if len(errs) > 0 {
+		err = errors.New(strings.Join(errs, "; "))
+	}
+	return status, chartSize, results, err
+}
+
+// destinationAttrs returns the logging attributes of helmChart along with its
+// destination when migrating to several of them.
+func (m *Migrator) destinationAttrs(helmChart HelmChart, destination ChartDestination) []any {
+	if len(m.destinations) == 1 {
+		return chartAttrs(helmChart)
+	}
+	return chartAttrs(helmChart, "destination", destination.String())
+}
+
+// contextWithTimeout returns a child context of ctx cancelled after timeout,
+// a zero timeout meaning the context is not cancelled on its own.
+func contextWithTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// chartAttrs returns the logging attributes of helmChart followed by args.
+func chartAttrs(helmChart HelmChart, args ...any) []any {
+	return append([]any{"project", helmChart.Project, "chart", helmChart.Name, "version", helmChart.Version}, args...)
+}
@@ -0,0 +1,302 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/errdef"
+	"oras.land/oras-go/v2/registry/remote"
+	"oras.land/oras-go/v2/registry/remote/auth"
+	"oras.land/oras-go/v2/registry/remote/errcode"
+)
+
+// Media types of the Helm chart OCI artifacts, as pushed by helm push.
+const (
+	helmConfigMediaType     = "application/vnd.cncf.helm.config.v1+json"
+	helmChartMediaType      = "application/vnd.cncf.helm.chart.content.v1.tar+gzip"
+	helmProvenanceMediaType = "application/vnd.cncf.helm.chart.provenance.v1.prov"
+)
+
+// Manifest annotations of AnnotateMigration, along with
+// ocispec.AnnotationSource set to the source URL of the Helm chart.
+const (
+	migratedFromAnnotation = "com.github.pacha5065.chartmuseum2oci.migrated-from"
+	migratedAtAnnotation   = "com.github.pacha5065.chartmuseum2oci.migrated-at"
+)
+
+// pushChart pushes the downloaded helmChart to the destination with the Pusher.
+func (d *harborDestination) pushChart(ctx context.Context, helmChart HelmChart) error {
+	if d.m.opts.Pusher == PusherOCI {
+		return d.m.redactError(d.pushChartWithOCIClient(ctx, helmChart))
+	}
+	return d.pushChartToDestination(ctx, helmChart)
+}
+
+// verifyChart verifies the pushed helmChart with the Pusher, the OCI client
+// one not requiring helm.
+func (d *harborDestination) verifyChart(ctx context.Context, helmChart HelmChart) error {
+	if d.m.opts.Pusher == PusherOCI {
+		return d.m.redactError(d.verifyPushedChartWithOCIClient(ctx, helmChart))
+	}
+	return d.verifyPushedChart(ctx, helmChart)
+}
+
+// pushChartWithOCIClient pushes helmChart to the destination registry as the
+// OCI artifact helm push makes, along with its provenance file if any.
+func (d *harborDestination) pushChartWithOCIClient(ctx context.Context, helmChart HelmChart) error {
+	repository, err := d.newOCIRepository(helmChart)
+	if err != nil {
+		return err
+	}
+
+	chartMetadata, err := readChartMetadata(d.m.chartFilePath(helmChart))
+	if err != nil {
+		return err
+	}
+	config, annotations, err := chartConfig(chartMetadata)
+	if err != nil {
+		return err
+	}
+	if d.m.opts.AnnotateMigration {
+		d.m.addMigrationAnnotations(annotations, helmChart)
+	}
+	configDescriptor, err := pushBlob(ctx, repository, helmConfigMediaType, config)
+	if err != nil {
+		return errors.Wrap(err, "Failed to push chart config")
+	}
+
+	chartContent, err := os.ReadFile(d.m.chartFilePath(helmChart))
+	if err != nil {
+		return err
+	}
+	chartDescriptor, err := pushBlob(ctx, repository, helmChartMediaType, chartContent)
+	if err != nil {
+		return errors.Wrap(err, "Failed to push chart content")
+	}
+	layers := []ocispec.Descriptor{chartDescriptor}
+
+	provenance, err := os.ReadFile(d.m.provenanceFilePath(helmChart))
+	switch {
+	case err == nil:
+		provenanceDescriptor, err := pushBlob(ctx, repository, helmProvenanceMediaType, provenance)
+		if err != nil {
+			return errors.Wrap(err, "Failed to push chart provenance")
+		}
+		layers = append(layers, provenanceDescriptor)
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	manifestDescriptor, err := oras.PackManifest(ctx, repository, oras.PackManifestVersion1_0, "", oras.PackManifestOptions{
+		Layers:              layers,
+		ConfigDescriptor:    &configDescriptor,
+		ManifestAnnotations: annotations,
+	})
+	if err != nil {
+		return classifyOCIError(errors.Wrap(err, "Failed to push chart manifest"))
+	}
+
+	if err := repository.Tag(ctx, manifestDescriptor, helmChart.Tag()); err != nil {
+		return classifyOCIError(errors.Wrap(err, "Failed to tag chart manifest"))
+	}
+	return nil
+}
+
+// verifyPushedChartWithOCIClient fetches the chart layer of helmChart back from
+// the destination registry and checks its SHA256 matches the one of the pushed
+// chart file.
+func (d *harborDestination) verifyPushedChartWithOCIClient(ctx context.Context, helmChart HelmChart) error {
+	pushedDigest, err := fileDigest(d.m.chartFilePath(helmChart))
+	if err != nil {
+		return errors.Wrap(err, "Failed to compute digest of pushed chart")
+	}
+
+	repository, err := d.newOCIRepository(helmChart)
+	if err != nil {
+		return err
+	}
+
+	manifestDescriptor, manifestContent, err := oras.FetchBytes(ctx, repository, helmChart.Tag(), oras.DefaultFetchBytesOptions)
+	if err != nil {
+		return classifyOCIError(errors.Wrap(err, "Failed to fetch chart manifest"))
+	}
+	if manifestDescriptor.MediaType != ocispec.MediaTypeImageManifest {
+		return errors.Errorf("unexpected chart manifest media type %s", manifestDescriptor.MediaType)
+	}
+
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(manifestContent, &manifest); err != nil {
+		return errors.Wrap(err, "Failed to parse chart manifest")
+	}
+	for _, layer := range manifest.Layers {
+		if layer.MediaType != helmChartMediaType {
+			continue
+		}
+
+		// The fetched content is checked against the layer digest.
+		if _, err := content.FetchAll(ctx, repository.Blobs(), layer); err != nil {
+			return classifyOCIError(errors.Wrap(err, "Failed to fetch chart content"))
+		}
+		if pulledDigest := layer.Digest.Encoded(); pulledDigest != pushedDigest {
+			return errors.Errorf("digest mismatch, pushed %s but pulled %s", pushedDigest, pulledDigest)
+		}
+		return nil
+	}
+
+	return errors.New("chart manifest has no chart content layer")
+}
+
+// ChartDigest returns the digest of the chart layer of the manifest of
+// helmChart in the destination registry, without fetching the layer.
+func (d *harborDestination) ChartDigest(ctx context.Context, helmChart HelmChart) (string, error) {
+	repository, err := d.newOCIRepository(helmChart)
+	if err != nil {
+		return "", err
+	}
+
+	manifestDescriptor, manifestContent, err := oras.FetchBytes(ctx, repository, helmChart.Tag(), oras.DefaultFetchBytesOptions)
+	if errors.Is(err, errdef.ErrNotFound) {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", d.m.redactError(classifyOCIError(errors.Wrap(err, "Failed to fetch chart manifest")))
+	}
+	if manifestDescriptor.MediaType != ocispec.MediaTypeImageManifest {
+		return "", errors.Errorf("unexpected chart manifest media type %s", manifestDescriptor.MediaType)
+	}
+
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(manifestContent, &manifest); err != nil {
+		return "", errors.Wrap(err, "Failed to parse chart manifest")
+	}
+	for _, layer := range manifest.Layers {
+		if layer.MediaType == helmChartMediaType {
+			return layer.Digest.Encoded(), nil
+		}
+	}
+	return "", errors.New("chart manifest has no chart content layer")
+}
+
+// newOCIRepository returns the client of the destination repository of
+// helmChart, authenticated with the destination credentials.
+func (d *harborDestination) newOCIRepository(helmChart HelmChart) (*remote.Repository, error) {
+	repository, err := remote.NewRepository(path.Join(d.registry, d.m.destinationProject(helmChart), d.m.destinationRepository(helmChart)))
+	if err != nil {
+		return nil, err
+	}
+	repository.PlainHTTP = strings.HasPrefix(d.url, "http://")
+	repository.Client = &auth.Client{
+		Client: d.m.httpClient,
+		Credential: auth.StaticCredential(d.registry, auth.Credential{
+			Username:    d.username,
+			Password:    d.password,
+			AccessToken: d.token,
+		}),
+		Cache: d.m.ociAuthCache,
+	}
+	return repository, nil
+}
+
+// chartMetadata is the Chart.yaml of a Helm chart, its fields being typed as
+// the chart.Metadata of helm which decodes the OCI config into it.
+type chartMetadata struct {
+	Name         string             `json:"name,omitempty" yaml:"name"`
+	Home         string             `json:"home,omitempty" yaml:"home"`
+	Sources      []string           `json:"sources,omitempty" yaml:"sources"`
+	Version      string             `json:"version,omitempty" yaml:"version"`
+	Description  string             `json:"description,omitempty" yaml:"description"`
+	Keywords     []string           `json:"keywords,omitempty" yaml:"keywords"`
+	Maintainers  []*chartMaintainer `json:"maintainers,omitempty" yaml:"maintainers"`
+	Icon         string             `json:"icon,omitempty" yaml:"icon"`
+	APIVersion   string             `json:"apiVersion,omitempty" yaml:"apiVersion"`
+	Condition    string             `json:"condition,omitempty" yaml:"condition"`
+	Tags         string             `json:"tags,omitempty" yaml:"tags"`
+	AppVersion   string             `json:"appVersion,omitempty" yaml:"appVersion"`
+	Deprecated   bool               `json:"deprecated,omitempty" yaml:"deprecated"`
+	Annotations  map[string]string  `json:"annotations,omitempty" yaml:"annotations"`
+	KubeVersion  string             `json:"kubeVersion,omitempty" yaml:"kubeVersion"`
+	Dependencies []*helmDependency  `json:"dependencies,omitempty" yaml:"dependencies"`
+	Type         string             `json:"type,omitempty" yaml:"type"`
+}
+
+type chartMaintainer struct {
+	Name  string `json:"name,omitempty" yaml:"name"`
+	Email string `json:"email,omitempty" yaml:"email"`
+	URL   string `json:"url,omitempty" yaml:"url"`
+}
+
+// chartConfig returns the OCI config of a Helm chart, its Chart.yaml as JSON,
+// along with the manifest annotations helm push derives from it. Unquoted
+// values such as appVersion: 1.0 are kept as the strings helm expects.
+func chartConfig(chartMetadataContent []byte) ([]byte, map[string]string, error) {
+	var metadata chartMetadata
+	if err := yaml.Unmarshal(chartMetadataContent, &metadata); err != nil {
+		return nil, nil, errors.Wrapf(err, "invalid %s", chartMetadataFileName)
+	}
+
+	config, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	annotations := make(map[string]string)
+	for annotation, value := range map[string]string{
+		ocispec.AnnotationTitle:       metadata.Name,
+		ocispec.AnnotationVersion:     metadata.Version,
+		ocispec.AnnotationDescription: metadata.Description,
+		ocispec.AnnotationURL:         metadata.Home,
+	} {
+		if value != "" {
+			annotations[annotation] = value
+		}
+	}
+	return config, annotations, nil
+}
+
+// addMigrationAnnotations records in annotations where helmChart was migrated
+// from and when.
+func (m *Migrator) addMigrationAnnotations(annotations map[string]string, helmChart HelmChart) {
+	annotations[ocispec.AnnotationSource] = m.source.ChartURL(helmChart)
+	if m.opts.SourceURL != "" {
+		annotations[migratedFromAnnotation] = m.opts.SourceURL
+	}
+	annotations[migratedAtAnnotation] = time.Now().UTC().Format(time.RFC3339)
+}
+
+// pushBlob pushes blob to repository unless it already has it.
+func pushBlob(ctx context.Context, repository *remote.Repository, mediaType string, blob []byte) (ocispec.Descriptor, error) {
+	descriptor := content.NewDescriptorFromBytes(mediaType, blob)
+
+	exists, err := repository.Exists(ctx, descriptor)
+	if err != nil {
+		return ocispec.Descriptor{}, classifyOCIError(err)
+	}
+	if exists {
+		return descriptor, nil
+	}
+
+	if err := repository.Push(ctx, descriptor, bytes.NewReader(blob)); err != nil {
+		return ocispec.Descriptor{}, classifyOCIError(err)
+	}
+	return descriptor, nil
+}
+
+// classifyOCIError marks the registry errors of a transient failure as retryable.
+func classifyOCIError(err error) error {
+	var errorResponse *errcode.ErrorResponse
+	if errors.As(err, &errorResponse) && (errorResponse.StatusCode == http.StatusTooManyRequests || errorResponse.StatusCode >= http.StatusInternalServerError) {
+		return retryable(err)
+	}
+	return err
+}
@@ -0,0 +1,56 @@
+package migrate
+
+import (
+	"encoding/json"
+	"testing"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestChartConfigStringFields(t *testing.T) {
+	chartYAML := []byte(`apiVersion: v2
+name: mychart
+version: 1
+appVersion: 1.0
+description: My chart
+home: https://example.com
+annotations:
+  revision: 42
+dependencies:
+  - name: common
+    version: 2
+    repository: https://charts.example.com
+`)
+
+	config, annotations, err := chartConfig(chartYAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var metadata struct {
+		Name         string            `json:"name"`
+		Version      string            `json:"version"`
+		AppVersion   string            `json:"appVersion"`
+		Annotations  map[string]string `json:"annotations"`
+		Dependencies []struct {
+			Version string `json:"version"`
+		} `json:"dependencies"`
+	}
+	if err := json.Unmarshal(config, &metadata); err != nil {
+		t.Fatalf("config %s does not decode as helm chart metadata: %v", config, err)
+	}
+	if metadata.Version != "1" || metadata.AppVersion != "1.0" || metadata.Annotations["revision"] != "42" || metadata.Dependencies[0].Version != "2" {
+		t.Errorf("config is %s, want the unquoted values as strings", config)
+	}
+
+	for annotation, want := range map[string]string{
+		ocispec.AnnotationTitle:       "mychart",
+		ocispec.AnnotationVersion:     "1",
+		ocispec.AnnotationDescription: "My chart",
+		ocispec.AnnotationURL:         "https://example.com",
+	} {
+		if annotations[annotation] != want {
+			t.Errorf("annotation %s is %s, want %s", annotation, annotations[annotation], want)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package migrate
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+
+	"github.com/go-openapi/runtime"
+	"github.com/goharbor/go-client/pkg/sdk/v2.0/client"
+	"github.com/goharbor/go-client/pkg/sdk/v2.0/client/project"
+	"github.com/goharbor/go-client/pkg/sdk/v2.0/models"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/singleflight"
+)
+
+// projectList lists the projects of a Harbor once for the whole migration, the
+// later calls reusing them instead of paginating through them again.
+type projectList struct {
+	apiClient *client.HarborAPI
+
+	mutex    sync.Mutex
+	listed   bool
+	projects []string
+}
+
+func newProjectList(apiClient *client.HarborAPI) *projectList {
+	return &projectList{apiClient: apiClient}
+}
+
+// get returns the projects of the Harbor visible with its credentials, listing
+// them on the first call, or again after a failure.
+func (l *projectList) get(ctx context.Context) ([]string, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if !l.listed {
+		projects, err := listProjects(ctx, l.apiClient)
+		if err != nil {
+			return nil, err
+		}
+		l.projects, l.listed = projects, true
+	}
+	return l.projects, nil
+}
+
+// destinationProjects creates the missing destination projects, checking each
+// of them only once for all the workers against the listed projects.
+type destinationProjects struct {
+	apiClient *client.HarborAPI
+	list      *projectList
+	public    bool
+	logger    *slog.Logger
+	// creating gathers the workers ensuring a same project into a single check.
+	creating singleflight.Group
+
+	mutex sync.Mutex
+	// checked are the errors of the projects checked for good, nil for the
+	// ones which exist, transient failures being checked again.
+	checked map[string]error
+}
+
+func newDestinationProjects(apiClient *client.HarborAPI, public bool, logger *slog.Logger) *destinationProjects {
+	return &destinationProjects{
+		apiClient: apiClient,
+		list:      newProjectList(apiClient),
+		public:    public,
+		logger:    logger,
+		checked:   make(map[string]error),
+	}
+}
+
+// ensure creates the destination project projectName unless it already exists.
+// The concurrent calls for a same project share a single check, which is not
+// cancelled with ctx so that the others get its result.
+func (p *destinationProjects) ensure(ctx context.Context, projectName string) error {
+	p.mutex.Lock()
+	err, ok := p.checked[projectName]
+	p.mutex.Unlock()
+	if ok {
+		return err
+	}
+
+	results := p.creating.DoChan(projectName, func() (any, error) {
+		err := p.create(context.WithoutCancel(ctx), projectName)
+		if err == nil || isPermanentProjectError(err) {
+			p.mutex.Lock()
+			p.checked[projectName] = err
+			p.mutex.Unlock()
+		}
+		return nil, err
+	})
+	select {
+	case result := <-results:
+		return result.Err
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+// isPermanentProjectError tells whether the creation of a project failed for
+// good, its name being invalid or the credentials not allowed to create it.
+func isPermanentProjectError(err error) bool {
+	var badRequest *project.CreateProjectBadRequest
+	var unauthorized *project.CreateProjectUnauthorized
+	var apiError *runtime.APIError
+	return errors.As(err, &badRequest) || errors.As(err, &unauthorized) ||
+		(errors.As(err, &apiError) && apiError.Code == http.StatusForbidden)
+}
+
+// missing returns the projects of projectNames which are not listed, a project
+// which is not visible with the destination credentials being missing as well.
+func (p *destinationProjects) missing(ctx context.Context, projectNames []string) ([]string, error) {
+	projects, err := p.list.get(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to list destination projects")
+	}
+
+	missing := make([]string, 0)
+	for _, projectName := range projectNames {
+		if !slices.Contains(projects, projectName) {
+			missing = append(missing, projectName)
+		}
+	}
+	return missing, nil
+}
+
+// create creates the project projectName unless listed, a project which is
+// not visible with the destination credentials being reported as a conflict.
+func (p *destinationProjects) create(ctx context.Context, projectName string) error {
+	projects, err := p.list.get(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Failed to list destination projects")
+	}
+	if slices.Contains(projects, projectName) {
+		return nil
+	}
+
+	ctx, cancel := contextWithTimeout(ctx, apiTimeout)
+	defer cancel()
+
+	projectReq := &models.ProjectReq{
+		ProjectName: projectName,
+		Public:      &p.public,
+	}
+	if _, err := p.apiClient.Project.CreateProject(ctx, project.NewCreateProjectParams().WithProject(projectReq)); err != nil {
+		var conflict *project.CreateProjectConflict
+		if errors.As(err, &conflict) {
+			return nil
+		}
+		return errors.Wrapf(err, "Failed to create project %s", projectName)
+	}
+
+	p.logger.Info("Created destination project", "project", projectName)
+	return nil
+}
@@ -0,0 +1,78 @@
+package migrate
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// newTestProjectHarbor returns the destinationProjects of a Harbor without
+// projects, answering the creations with the statuses in turn, the last one
+// being repeated, and the number of creations it received.
+func newTestProjectHarbor(t *testing.T, statuses ...int) (*destinationProjects, *atomic.Int32) {
+	t.Helper()
+
+	var creations atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			writeTestJSON(w, []any{})
+			return
+		}
+		creation := int(creations.Add(1))
+		w.WriteHeader(statuses[min(creation, len(statuses))-1])
+	}))
+	t.Cleanup(server.Close)
+
+	apiClient, err := newHarborClient(server.URL, "user", "password", "", http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newDestinationProjects(apiClient.v2, false, slog.New(slog.NewTextHandler(io.Discard, nil))), &creations
+}
+
+func TestEnsureProjectRetriesTransientFailures(t *testing.T) {
+	projects, creations := newTestProjectHarbor(t, http.StatusInternalServerError, http.StatusCreated)
+
+	if err := projects.ensure(context.Background(), "team"); err == nil {
+		t.Fatal("ensured project despite the creation failure")
+	}
+	if err := projects.ensure(context.Background(), "team"); err != nil {
+		t.Fatalf("failed to ensure project once Harbor recovered: %v", err)
+	}
+	if err := projects.ensure(context.Background(), "team"); err != nil {
+		t.Fatalf("failed to ensure created project: %v", err)
+	}
+	if count := creations.Load(); count != 2 {
+		t.Errorf("created project %d times, want 2", count)
+	}
+}
+
+func TestEnsureProjectCachesPermanentFailures(t *testing.T) {
+	projects, creations := newTestProjectHarbor(t, http.StatusForbidden)
+
+	for i := 0; i < 3; i++ {
+		if err := projects.ensure(context.Background(), "team"); err == nil {
+			t.Fatal("ensured project despite the forbidden creation")
+		}
+	}
+	if count := creations.Load(); count != 1 {
+		t.Errorf("created project %d times, want 1", count)
+	}
+}
+
+func TestEnsureProjectIgnoresCancelledContext(t *testing.T) {
+	projects, _ := newTestProjectHarbor(t, http.StatusCreated)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// The check may complete or not before ensure returns, the cancellation
+	// error being never kept for the later calls.
+	_ = projects.ensure(ctx, "team")
+	if err := projects.ensure(context.Background(), "team"); err != nil {
+		t.Fatalf("failed to ensure project after a cancelled check: %v", err)
+	}
+}
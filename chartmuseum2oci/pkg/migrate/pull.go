@@ -0,0 +1,248 @@
+package migrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// pullChartFromSource downloads the archive of a Helm chart, resuming the
+// partial download of a previous attempt if the source supports it and lists
+// the digest of the chart, a resumed download being always verified against it
+// as its parts may come from two different files.
+func (m *Migrator) pullChartFromSource(ctx context.Context, helmChart HelmChart) error {
+	expectedDigest := helmChart.Digest
+	if m.opts.SkipVerifyDigest {
+		expectedDigest = ""
+	}
+
+	var resume func(context.Context, int64) (io.ReadCloser, int64, error)
+	if source, ok := m.source.(ResumableChartSource); ok && helmChart.Digest != "" {
+		resume = func(ctx context.Context, offset int64) (io.ReadCloser, int64, error) {
+			return source.ResumeChart(ctx, helmChart, offset)
+		}
+	}
+	return m.redactError(m.withReauthentication(ctx, func() error {
+		return m.pullFile(ctx, m.source.PullChart, resume, helmChart, m.chartFilePath(helmChart), expectedDigest, m.opts.MaxChartSize)
+	}))
+}
+
+// pullProvenanceFromSource downloads the provenance file of a signed Helm chart
+// next to its chart file, for helm push to push it along, charts without one
+// being left as they are.
+func (m *Migrator) pullProvenanceFromSource(ctx context.Context, helmChart HelmChart) error {
+	err := m.withReauthentication(ctx, func() error {
+		return m.pullFile(ctx, m.source.PullProvenance, nil, helmChart, m.provenanceFilePath(helmChart), "", 0)
+	})
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return m.redactError(err)
+}
+
+// withReauthentication runs operation, a pull or a delete, running it once more
+// when it fails with ErrInvalidCredentials and a ReauthenticatingChartSource
+// could renew its credentials, e.g. once its token expired during a long
+// migration.
+func (m *Migrator) withReauthentication(ctx context.Context, operation func() error) error {
+	err := operation()
+	source, ok := m.source.(ReauthenticatingChartSource)
+	if !ok || !errors.Is(err, ErrInvalidCredentials) {
+		return err
+	}
+
+	if reauthErr := source.Reauthenticate(ctx); reauthErr != nil {
+		m.logger.Debug("Failed to reauthenticate to source", "error", reauthErr)
+		return err
+	}
+	m.logger.Info("Reauthenticated to source which rejected its credentials")
+	return operation()
+}
+
+// pullFile writes the file of helmChart opened by pull to filePath, within the
+// PullTimeout, once checked there is enough disk space for it if its size is
+// known. Files larger than maxSize, if not 0, are rejected with errTooLarge,
+// whether their size is known or not. The download is throttled to the
+// MaxBandwidth shared with the other workers.
+//
+// With resume, the partial file of a download failing midway is kept when the
+// source accepts ranges, for the next call to resume it from where it stopped,
+// the resumed file being then verified against the digest of helmChart even
+// without expectedDigest.
+func (m *Migrator) pullFile(ctx context.Context, pull func(context.Context, HelmChart) (io.ReadCloser, error), resume func(context.Context, int64) (io.ReadCloser, int64, error), helmChart HelmChart, filePath, expectedDigest string, maxSize int64) error {
+	ctx, cancel := contextWithTimeout(ctx, m.opts.PullTimeout)
+	defer cancel()
+
+	content, offset, err := m.openFile(ctx, pull, resume, helmChart, filePath)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	if offset > 0 {
+		expectedDigest = helmChart.Digest
+	}
+
+	if sized, ok := content.(interface{ Size() int64 }); ok && sized.Size() > 0 {
+		if maxSize > 0 && offset+sized.Size() > maxSize {
+			return tooLargeError(offset+sized.Size(), maxSize)
+		}
+		if err := m.checkFreeSpace(sized.Size()); err != nil {
+			return err
+		}
+	}
+
+	var reader io.Reader = content
+	if maxSize > 0 {
+		// The Content-Length may be missing or wrong.
+		reader = &maxSizeReader{reader: content, maxSize: maxSize, read: offset}
+	}
+	if m.bandwidth != nil {
+		reader = m.bandwidth.reader(ctx, reader)
+	}
+
+	acceptRanges, ok := content.(interface{ AcceptRanges() bool })
+	keepPart := resume != nil && ok && acceptRanges.AcceptRanges()
+	return writeFile(filePath, reader, expectedDigest, offset, keepPart)
+}
+
+// openFile opens the file of helmChart from the end of its partial file if any
+// and resume is given, returning the offset it starts at, 0 when it is opened
+// from the start.
+func (m *Migrator) openFile(ctx context.Context, pull func(context.Context, HelmChart) (io.ReadCloser, error), resume func(context.Context, int64) (io.ReadCloser, int64, error), helmChart HelmChart, filePath string) (io.ReadCloser, int64, error) {
+	info, err := os.Stat(filePath + partFileSuffix)
+	if resume == nil || err != nil || info.Size() == 0 {
+		content, err := pull(ctx, helmChart)
+		return content, 0, err
+	}
+
+	m.logger.Debug("Resuming download of Helm chart", chartAttrs(helmChart, "offset", info.Size())...)
+	content, offset, err := resume(ctx, info.Size())
+	if err != nil {
+		if isRetryable(err) {
+			return nil, 0, err
+		}
+		// The server may not accept the range, e.g. beyond a file which
+		// changed, the download restarts from scratch.
+		m.logger.Debug("Failed to resume download of Helm chart, restarting it", chartAttrs(helmChart, "error", err)...)
+		content, err := pull(ctx, helmChart)
+		return content, 0, err
+	}
+	if offset == 0 {
+		m.logger.Debug("Source does not accept ranges, restarting download of Helm chart", chartAttrs(helmChart)...)
+	}
+	return content, offset, nil
+}
+
+var errTooLarge = errors.New("chart exceeds the maximum size")
+
+func tooLargeError(size, maxSize int64) error {
+	return errors.Wrapf(errTooLarge, "Chart of %s is larger than %s", FormatSize(size), FormatSize(maxSize))
+}
+
+// maxSizeReader reads from reader, failing with errTooLarge once more than
+// maxSize bytes were read.
+type maxSizeReader struct {
+	reader  io.Reader
+	maxSize int64
+	read    int64
+}
+
+func (r *maxSizeReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.read += int64(n)
+	if r.read > r.maxSize {
+		return n, errors.Wrapf(errTooLarge, "Chart is larger than %s", FormatSize(r.maxSize))
+	}
+	return n, err
+}
+
+// chartFilePath returns the path the Helm chart is downloaded to, within a
+// directory of its project to avoid clashes between projects.
+func (m *Migrator) chartFilePath(helmChart HelmChart) string {
+	return filepath.Join(m.workDir, helmChart.Project, helmChart.ChartFileName())
+}
+
+// provenanceFilePath returns the path the provenance file of the Helm chart is
+// downloaded to, where helm push looks for it.
+func (m *Migrator) provenanceFilePath(helmChart HelmChart) string {
+	return m.chartFilePath(helmChart) + provenanceFileSuffix
+}
+
+func (m *Migrator) removeChartFile(helmChart HelmChart) error {
+	if err := os.Remove(m.provenanceFilePath(helmChart)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(m.chartFilePath(helmChart))
+}
+
+// writeChartFile streams the chart content into a temporary file which is renamed
+// to chartFileName once fully written, so a partial download never looks complete.
+// The file is discarded if its SHA256 does not match expectedDigest, if any.
+func writeChartFile(chartFileName string, content io.Reader, expectedDigest string) error {
+	return writeFile(chartFileName, content, expectedDigest, 0, false)
+}
+
+// writeFile is writeChartFile appending content to the temporary file from
+// offset when not 0, the SHA256 covering the whole file. With keepPart, the
+// temporary file is kept when content fails to be read, to be resumed.
+func writeFile(fileName string, content io.Reader, expectedDigest string, offset int64, keepPart bool) error {
+	if err := os.MkdirAll(filepath.Dir(fileName), dirMode); err != nil {
+		return err
+	}
+
+	tmpFileName := fileName + partFileSuffix
+	flags := os.O_CREATE | os.O_RDWR | os.O_TRUNC
+	if offset > 0 {
+		flags = os.O_RDWR
+	}
+	tmpFile, err := os.OpenFile(tmpFileName, flags, fileMode)
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.New()
+	if offset > 0 {
+		// The part downloaded by a previous attempt is hashed again, dropping
+		// whatever was written beyond offset.
+		if _, err := io.CopyN(hash, tmpFile, offset); err != nil {
+			tmpFile.Close()
+			os.Remove(tmpFileName)
+			return errors.Wrap(err, "Failed to read partial chart file")
+		}
+		if err := tmpFile.Truncate(offset); err != nil {
+			tmpFile.Close()
+			os.Remove(tmpFileName)
+			return err
+		}
+	}
+
+	if _, err := io.Copy(io.MultiWriter(tmpFile, hash), content); err != nil {
+		tmpFile.Close()
+		if !keepPart || errors.Is(err, errTooLarge) {
+			os.Remove(tmpFileName)
+		}
+		return errors.Wrap(err, "Failed to write chart file")
+	}
+
+	if err := tmpFile.Close(); err != nil {
+		os.Remove(tmpFileName)
+		return err
+	}
+
+	if expectedDigest != "" {
+		digest := hex.EncodeToString(hash.Sum(nil))
+		if !strings.EqualFold(strings.TrimPrefix(expectedDigest, "sha256:"), digest) {
+			os.Remove(tmpFileName)
+			// A corrupted download is worth retrying.
+			return retryable(errors.Errorf("digest mismatch, expected %s but downloaded %s", expectedDigest, digest))
+		}
+	}
+
+	return os.Rename(tmpFileName, fileName)
+}
@@ -0,0 +1,106 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// interruptedSource is a ResumableChartSource whose first download fails
+// midway, the resumed one sending the end of resumedContent.
+type interruptedSource struct {
+	ChartSource
+	content        []byte
+	resumedContent []byte
+	pulls          int
+	resumes        int
+}
+
+// rangeContent is a download of a source accepting ranges, failing with err
+// once read.
+type rangeContent struct {
+	io.Reader
+	err error
+}
+
+func (c *rangeContent) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	if err == io.EOF && c.err != nil {
+		return n, c.err
+	}
+	return n, err
+}
+
+func (c *rangeContent) Close() error       { return nil }
+func (c *rangeContent) AcceptRanges() bool { return true }
+
+func (s *interruptedSource) PullChart(context.Context, HelmChart) (io.ReadCloser, error) {
+	s.pulls++
+	if s.pulls == 1 {
+		return &rangeContent{Reader: bytes.NewReader(s.content[:len(s.content)/2]), err: errors.New("connection reset by peer")}, nil
+	}
+	return &rangeContent{Reader: bytes.NewReader(s.content)}, nil
+}
+
+func (s *interruptedSource) ResumeChart(_ context.Context, _ HelmChart, offset int64) (io.ReadCloser, int64, error) {
+	s.resumes++
+	return &rangeContent{Reader: bytes.NewReader(s.resumedContent[offset:])}, offset, nil
+}
+
+func TestPullResumedChartVerifiesDigest(t *testing.T) {
+	content := bytes.Repeat([]byte("chart"), 100)
+	changedContent := bytes.Repeat([]byte("CHART"), 100)
+	digest := sha256.Sum256(content)
+
+	for _, test := range []struct {
+		name             string
+		digest           string
+		skipVerifyDigest bool
+		resumedContent   []byte
+		wantResumes      int
+		wantErr          bool
+	}{
+		{name: "same file", digest: hex.EncodeToString(digest[:]), resumedContent: content, wantResumes: 1},
+		{name: "changed file", digest: hex.EncodeToString(digest[:]), resumedContent: changedContent, wantResumes: 1, wantErr: true},
+		{name: "changed file without verification", digest: hex.EncodeToString(digest[:]), skipVerifyDigest: true, resumedContent: changedContent, wantResumes: 1, wantErr: true},
+		{name: "unknown digest", resumedContent: changedContent, wantResumes: 0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			source := &interruptedSource{content: content, resumedContent: test.resumedContent}
+			m := &Migrator{
+				opts:    Options{SkipVerifyDigest: test.skipVerifyDigest},
+				logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+				source:  source,
+				workDir: t.TempDir(),
+			}
+			helmChart := HelmChart{Name: "mychart", Project: "library", Version: "1.0.0", Digest: test.digest}
+
+			if err := m.pullChartFromSource(context.Background(), helmChart); err == nil {
+				t.Fatal("interrupted download succeeded")
+			}
+			err := m.pullChartFromSource(context.Background(), helmChart)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("second download failed with %v, want error %t", err, test.wantErr)
+			}
+			if source.resumes != test.wantResumes {
+				t.Errorf("resumed download %d times, want %d", source.resumes, test.wantResumes)
+			}
+			if err == nil {
+				pulled, err := os.ReadFile(m.chartFilePath(helmChart))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(pulled, content) {
+					t.Error("pulled chart file differs from the source one")
+				}
+			}
+		})
+	}
+}
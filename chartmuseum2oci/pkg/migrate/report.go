@@ -0,0 +1,61 @@
+package migrate
+
+import "time"
+
+// ChartStatus is the outcome of the migration of a Helm chart.
+type ChartStatus string
+
+const (
+	StatusMigrated ChartStatus = "migrated"
+	StatusSkipped  ChartStatus = "skipped"
+	StatusFailed   ChartStatus = "failed"
+)
+
+// ChartResult is the result of the migration of a Helm chart.
+type ChartResult struct {
+	Project    string      `json:"project"`
+	Name       string      `json:"name"`
+	Version    string      `json:"version"`
+	Status     ChartStatus `json:"status"`
+	Error      string      `json:"error,omitempty"`
+	Bytes      int64       `json:"bytes"`
+	DurationMs int64       `json:"durationMs"`
+	// Destinations are the results of each destination, only when migrating
+	// to several of them.
+	Destinations []DestinationResult `json:"destinations,omitempty"`
+}
+
+// DestinationResult is the result of the migration of a Helm chart to one of
+// the destinations.
+type DestinationResult struct {
+	Destination string      `json:"destination"`
+	Status      ChartStatus `json:"status"`
+	Error       string      `json:"error,omitempty"`
+}
+
+func newChartResult(helmChart HelmChart, status ChartStatus, chartSize int64, destinations []DestinationResult, err error, duration time.Duration) ChartResult {
+	result := ChartResult{
+		Project:      helmChart.Project,
+		Name:         helmChart.Name,
+		Version:      helmChart.Version,
+		Status:       status,
+		Bytes:        chartSize,
+		DurationMs:   duration.Milliseconds(),
+		Destinations: destinations,
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func newDestinationResult(destination ChartDestination, status ChartStatus, err error) DestinationResult {
+	result := DestinationResult{
+		Destination: destination.String(),
+		Status:      status,
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
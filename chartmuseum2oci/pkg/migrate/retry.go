@@ -0,0 +1,143 @@
+package migrate
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	retryBaseDelay = 1 * time.Second
+	retryMaxDelay  = 30 * time.Second
+)
+
+// retryableHelmOutputs are the helm error outputs of a transient failure.
+var retryableHelmOutputs = []string{
+	"connection reset by peer",
+	"i/o timeout",
+	"TLS handshake timeout",
+	"500 Internal Server Error",
+	"502 Bad Gateway",
+	"503 Service Unavailable",
+	"504 Gateway Timeout",
+}
+
+// retryableError marks an error as transient, the failed operation being worth retrying.
+type retryableError struct {
+	err error
+}
+
+func (e retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (e retryableError) Unwrap() error {
+	return e.err
+}
+
+func retryable(err error) error {
+	return retryableError{err: err}
+}
+
+// retryAfterError is a retryable error for which the server told how long to wait
+// before retrying, e.g. through the Retry-After header of a 429 response.
+type retryAfterError struct {
+	retryableError
+	delay time.Duration
+}
+
+func retryAfter(err error, delay time.Duration) error {
+	return retryAfterError{retryableError: retryableError{err: err}, delay: delay}
+}
+
+// parseRetryAfter parses a Retry-After header value, given either in seconds or as an HTTP date.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+
+	if delay := date.Sub(now); delay > 0 {
+		return delay, true
+	}
+	return 0, true
+}
+
+func isRetryable(err error) bool {
+	var retryableErr retryableError
+	var retryAfterErr retryAfterError
+	if errors.As(err, &retryableErr) || errors.As(err, &retryAfterErr) {
+		return true
+	}
+
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func isRetryableHelmOutput(output string) bool {
+	for _, retryableOutput := range retryableHelmOutputs {
+		if strings.Contains(output, retryableOutput) {
+			return true
+		}
+	}
+	return false
+}
+
+// withRetry runs operation until it succeeds, fails with a non retryable error
+// or MaxRetries retries were made, waiting an exponential backoff between attempts
+// unless the server asked for a longer delay.
+func (m *Migrator) withRetry(ctx context.Context, operationName string, helmChart HelmChart, operation func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := operation()
+		if err == nil || ctx.Err() != nil || attempt >= m.opts.MaxRetries || !isRetryable(err) {
+			return err
+		}
+
+		delay := backoffDelay(attempt)
+		var retryAfterErr retryAfterError
+		if errors.As(err, &retryAfterErr) && retryAfterErr.delay > delay {
+			delay = retryAfterErr.delay
+		}
+		m.logger.Debug("Retrying "+operationName+" of Helm chart", chartAttrs(helmChart, "delay", delay, "attempt", attempt+1, "maxRetries", m.opts.MaxRetries, "error", err)...)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// backoffDelay returns the delay before the retry following attempt, doubling
+// with each attempt up to retryMaxDelay, half of it being random jitter.
+func backoffDelay(attempt int) time.Duration {
+	delay := retryMaxDelay
+	if attempt < 16 && retryBaseDelay<<attempt < retryMaxDelay {
+		delay = retryBaseDelay << attempt
+	}
+
+	//nolint:gosec // jitter does not need a cryptographically secure source
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
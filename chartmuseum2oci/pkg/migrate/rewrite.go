@@ -0,0 +1,401 @@
+package migrate
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// chartNameRegexp matches the valid names of Helm charts, which are also OCI
+// repository names once lowercase.
+var chartNameRegexp = regexp.MustCompile(`^[A-Za-z0-9]+([._-][A-Za-z0-9]+)*$`)
+
+const (
+	valuesFileName    = "values.yaml"
+	subchartsDir      = "charts"
+	chartLockFileName = "Chart.lock"
+)
+
+// NameRewrite renames the Helm charts whose name matches the regular
+// expression Pattern, replacing the matches by Replacement, which may refer to
+// the submatches as $1.
+type NameRewrite struct {
+	Pattern     string
+	Replacement string
+}
+
+type nameRewrite struct {
+	regexp      *regexp.Regexp
+	replacement string
+}
+
+func compileNameRewrites(rewrites []NameRewrite) ([]nameRewrite, error) {
+	nameRewrites := make([]nameRewrite, 0, len(rewrites))
+	for _, rewrite := range rewrites {
+		re, err := regexp.Compile(rewrite.Pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid name rewrite pattern %s", rewrite.Pattern)
+		}
+		nameRewrites = append(nameRewrites, nameRewrite{regexp: re, replacement: rewrite.Replacement})
+	}
+	return nameRewrites, nil
+}
+
+// rewriteName returns the name of a Helm chart rewritten by the NameRewrites,
+// failing when it is no longer a valid chart name.
+func (m *Migrator) rewriteName(name string) (string, error) {
+	newName := name
+	for _, rewrite := range m.nameRewrites {
+		newName = rewrite.regexp.ReplaceAllString(newName, rewrite.replacement)
+	}
+	if !chartNameRegexp.MatchString(newName) {
+		return "", errors.Errorf("Invalid name %s of Helm chart %s once rewritten", newName, name)
+	}
+	return newName, nil
+}
+
+// imageRewrite replaces the image registry prefix of the image references by
+// replacement.
+type imageRewrite struct {
+	prefix      string
+	replacement string
+}
+
+// newImageRewrites returns the rewrites of the Options.ImageRewrites, the
+// longest prefixes first so that they take precedence.
+func newImageRewrites(rewrites map[string]string) []imageRewrite {
+	imageRewrites := make([]imageRewrite, 0, len(rewrites))
+	for prefix, replacement := range rewrites {
+		imageRewrites = append(imageRewrites, imageRewrite{prefix: strings.TrimRight(prefix, "/"), replacement: strings.TrimRight(replacement, "/")})
+	}
+	sort.Slice(imageRewrites, func(i, j int) bool {
+		return len(imageRewrites[i].prefix) > len(imageRewrites[j].prefix)
+	})
+	return imageRewrites
+}
+
+// rewriteImage returns value with its image registry prefix rewritten, value
+// being either the prefix itself, e.g. an image.registry value, or a reference
+// starting with it, and whether a rewrite matched.
+func rewriteImage(value string, rewrites []imageRewrite) (string, bool) {
+	for _, rewrite := range rewrites {
+		if value == rewrite.prefix {
+			return rewrite.replacement, true
+		}
+		if strings.HasPrefix(value, rewrite.prefix+"/") {
+			return rewrite.replacement + strings.TrimPrefix(value, rewrite.prefix), true
+		}
+	}
+	return value, false
+}
+
+// rewriteChartImages rewrites the image references of the values.yaml of the
+// Helm chart archive at chartFilePath and of its subcharts, unpacked or not,
+// leaving the archive untouched when none matched, and tells whether some did.
+func rewriteChartImages(chartFilePath string, rewrites []imageRewrite) (bool, error) {
+	var changed bool
+	return repackChartIfChanged(chartFilePath, imagesTransform(rewrites, &changed), &changed)
+}
+
+// repackChartIfChanged repacks the Helm chart archive at chartFilePath with
+// transform, which sets changed once it changes a file, leaving the archive
+// untouched when it did not, and tells whether it did.
+func repackChartIfChanged(chartFilePath string, transform chartFileTransform, changed *bool) (bool, error) {
+	tmpFileName := chartFilePath + ".repack"
+	if err := writeRepackedChart(chartFilePath, tmpFileName, transform); err != nil {
+		os.Remove(tmpFileName)
+		return false, errors.Wrap(err, "Failed to repack chart")
+	}
+
+	if !*changed {
+		return false, os.Remove(tmpFileName)
+	}
+	return true, os.Rename(tmpFileName, chartFilePath)
+}
+
+// imagesTransform returns the chartFileTransform rewriting the image references
+// of the values.yaml files and of the packaged subcharts, setting changed once
+// a file is rewritten.
+func imagesTransform(rewrites []imageRewrite, changed *bool) chartFileTransform {
+	return func(name string, content []byte) ([]byte, error) {
+		switch {
+		case isValuesFile(name):
+			rewritten, err := rewriteValuesImages(content, rewrites)
+			if err != nil || rewritten == nil {
+				return content, err
+			}
+			*changed = true
+			return rewritten, nil
+		case isPackagedSubchart(name):
+			var subchartChanged bool
+			var buf bytes.Buffer
+			if err := repackArchive(bytes.NewReader(content), &buf, imagesTransform(rewrites, &subchartChanged)); err != nil {
+				return nil, err
+			}
+			if !subchartChanged {
+				return content, nil
+			}
+			*changed = true
+			return buf.Bytes(), nil
+		default:
+			return content, nil
+		}
+	}
+}
+
+// isValuesFile tells whether name is the values.yaml of the chart within its
+// archive or of one of its unpacked subcharts, e.g. mychart/values.yaml or
+// mychart/charts/subchart/values.yaml.
+func isValuesFile(name string) bool {
+	parts := strings.Split(name, "/")
+	return len(parts)%2 == 0 && parts[len(parts)-1] == valuesFileName && areSubchartDirs(parts[:len(parts)-1])
+}
+
+// isPackagedSubchart tells whether name is a subchart archive within a chart
+// archive, e.g. mychart/charts/subchart-1.0.0.tgz.
+func isPackagedSubchart(name string) bool {
+	parts := strings.Split(name, "/")
+	return len(parts)%2 == 1 && len(parts) > 1 && strings.HasSuffix(name, ".tgz") && areSubchartDirs(parts[:len(parts)-1])
+}
+
+// areSubchartDirs tells whether dirs are the directories of a chart and of its
+// nested subcharts, each one but the first being under charts.
+func areSubchartDirs(dirs []string) bool {
+	for i, dir := range dirs {
+		if dir == "" || (i%2 == 1 && dir != subchartsDir) {
+			return false
+		}
+	}
+	return true
+}
+
+// rewriteValuesImages returns the values.yaml content with the image
+// references of its string values rewritten at any depth, keeping the
+// comments, nil when none matched.
+func rewriteValuesImages(values []byte, rewrites []imageRewrite) ([]byte, error) {
+	var document yaml.Node
+	if err := yaml.Unmarshal(values, &document); err != nil {
+		return nil, errors.Wrapf(err, "invalid %s", valuesFileName)
+	}
+
+	if !rewriteNodeImages(&document, rewrites) {
+		return nil, nil
+	}
+
+	return encodeYAML(&document)
+}
+
+// rewriteNodeImages rewrites the image references of the string scalars of
+// node and of its children, except the keys of the mappings, and tells whether
+// any was.
+func rewriteNodeImages(node *yaml.Node, rewrites []imageRewrite) bool {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if node.ShortTag() != "!!str" {
+			return false
+		}
+		value, ok := rewriteImage(node.Value, rewrites)
+		node.Value = value
+		return ok
+	case yaml.MappingNode:
+		rewritten := false
+		for i := 1; i < len(node.Content); i += 2 {
+			rewritten = rewriteNodeImages(node.Content[i], rewrites) || rewritten
+		}
+		return rewritten
+	default:
+		rewritten := false
+		for _, child := range node.Content {
+			rewritten = rewriteNodeImages(child, rewrites) || rewritten
+		}
+		return rewritten
+	}
+}
+
+// dependencyRewrites returns the rewrites of the dependency repositories of
+// helmChart, the DependencyRewrites along with, with RewriteDependencies, the
+// one of its source repository to its repository in a Harbor destination.
+func (m *Migrator) dependencyRewrites(helmChart HelmChart) map[string]string {
+	rewrites := make(map[string]string, len(m.opts.DependencyRewrites)+1)
+	for repository, newRepository := range m.opts.DependencyRewrites {
+		rewrites[strings.TrimRight(repository, "/")] = newRepository
+	}
+
+	if harbor, ok := m.destinations[0].(*harborDestination); ok && m.opts.RewriteDependencies {
+		sourceRepository := strings.TrimSuffix(m.source.ChartURL(helmChart), "/charts/"+helmChart.ChartFileName())
+		if _, ok := rewrites[sourceRepository]; !ok {
+			rewrites[sourceRepository] = harbor.destinationRepoURL(helmChart)
+		}
+	}
+	return rewrites
+}
+
+// helmDependency is a dependency of a Chart.yaml or Chart.lock, with the JSON
+// encoding helm computes the digest of the Chart.lock from.
+type helmDependency struct {
+	Name         string   `json:"name" yaml:"name"`
+	Version      string   `json:"version,omitempty" yaml:"version"`
+	Repository   string   `json:"repository" yaml:"repository"`
+	Condition    string   `json:"condition,omitempty" yaml:"condition"`
+	Tags         []string `json:"tags,omitempty" yaml:"tags"`
+	Enabled      bool     `json:"enabled,omitempty" yaml:"enabled"`
+	ImportValues []any    `json:"import-values,omitempty" yaml:"import-values"`
+	Alias        string   `json:"alias,omitempty" yaml:"alias"`
+}
+
+// dependenciesFile is the content of a Chart.yaml or Chart.lock.
+type dependenciesFile struct {
+	Dependencies []*helmDependency `yaml:"dependencies"`
+	Digest       string            `yaml:"digest"`
+}
+
+// rewriteChartDependencies rewrites the repositories of the dependencies of
+// the Chart.yaml and of the Chart.lock of the Helm chart archive at
+// chartFilePath from the keys of rewrites to their values, updating the digest
+// of the Chart.lock if it was in sync, and tells whether any was rewritten.
+func rewriteChartDependencies(chartFilePath string, rewrites map[string]string) (bool, error) {
+	chartMetadata, err := readChartMetadata(chartFilePath)
+	if err != nil {
+		return false, err
+	}
+	rewrittenMetadata, err := rewriteDependencyRepositories(chartMetadata, rewrites)
+	if err != nil {
+		return false, errors.Wrapf(err, "invalid %s", chartMetadataFileName)
+	}
+
+	var changed bool
+	transform := func(name string, content []byte) ([]byte, error) {
+		switch {
+		case isChartMetadataFile(name) && rewrittenMetadata != nil:
+			changed = true
+			return rewrittenMetadata, nil
+		case isChartFile(name, chartLockFileName):
+			rewrittenLock, err := rewriteChartLock(content, rewrites, chartMetadata, rewrittenMetadata)
+			if err != nil || rewrittenLock == nil {
+				return content, err
+			}
+			changed = true
+			return rewrittenLock, nil
+		default:
+			return content, nil
+		}
+	}
+	return repackChartIfChanged(chartFilePath, transform, &changed)
+}
+
+// rewriteDependencyRepositories returns the Chart.yaml or Chart.lock content
+// with the repositories of its dependencies rewritten, keeping the comments,
+// nil when none matched.
+func rewriteDependencyRepositories(content []byte, rewrites map[string]string) ([]byte, error) {
+	var document yaml.Node
+	if err := yaml.Unmarshal(content, &document); err != nil {
+		return nil, err
+	}
+	dependencies := mappingValue(&document, "dependencies")
+	if dependencies == nil || dependencies.Kind != yaml.SequenceNode {
+		return nil, nil
+	}
+
+	rewritten := false
+	for _, dependency := range dependencies.Content {
+		repository := mappingValue(dependency, "repository")
+		if repository == nil || repository.Kind != yaml.ScalarNode {
+			continue
+		}
+		if newRepository, ok := rewrites[strings.TrimRight(repository.Value, "/")]; ok {
+			repository.SetString(newRepository)
+			rewritten = true
+		}
+	}
+	if !rewritten {
+		return nil, nil
+	}
+	return encodeYAML(&document)
+}
+
+// rewriteChartLock returns the Chart.lock content with the repositories of its
+// dependencies rewritten and its digest updated if it matched the original
+// Chart.yaml, nil when unchanged.
+func rewriteChartLock(lock []byte, rewrites map[string]string, chartMetadata, rewrittenMetadata []byte) ([]byte, error) {
+	rewrittenLock, err := rewriteDependencyRepositories(lock, rewrites)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid %s", chartLockFileName)
+	}
+	if rewrittenLock == nil && rewrittenMetadata == nil {
+		return nil, nil
+	}
+	if rewrittenLock == nil {
+		rewrittenLock = lock
+	}
+	if rewrittenMetadata == nil {
+		rewrittenMetadata = chartMetadata
+	}
+
+	digest, err := dependenciesDigest(chartMetadata, lock)
+	if err != nil {
+		return nil, err
+	}
+	var lockFile dependenciesFile
+	if err := yaml.Unmarshal(lock, &lockFile); err != nil {
+		return nil, errors.Wrapf(err, "invalid %s", chartLockFileName)
+	}
+	if lockFile.Digest != digest {
+		// Out of sync already, helm rejects it anyway.
+		return rewrittenLock, nil
+	}
+
+	if digest, err = dependenciesDigest(rewrittenMetadata, rewrittenLock); err != nil {
+		return nil, err
+	}
+	var document yaml.Node
+	if err := yaml.Unmarshal(rewrittenLock, &document); err != nil {
+		return nil, err
+	}
+	if digestNode := mappingValue(&document, "digest"); digestNode != nil {
+		digestNode.SetString(digest)
+	}
+	return encodeYAML(&document)
+}
+
+// dependenciesDigest returns the digest of the dependencies of a Chart.yaml
+// and of its Chart.lock, as computed by helm to detect the out of sync ones.
+func dependenciesDigest(chartMetadata, lock []byte) (string, error) {
+	var metadataFile, lockFile dependenciesFile
+	if err := yaml.Unmarshal(chartMetadata, &metadataFile); err != nil {
+		return "", errors.Wrapf(err, "invalid %s", chartMetadataFileName)
+	}
+	if err := yaml.Unmarshal(lock, &lockFile); err != nil {
+		return "", errors.Wrapf(err, "invalid %s", chartLockFileName)
+	}
+
+	data, err := json.Marshal([2][]*helmDependency{metadataFile.Dependencies, lockFile.Dependencies})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(data)), nil
+}
+
+// mappingValue returns the value of key in the mapping of node, or of the
+// document node holds, nil when missing.
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package migrate
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRewriteName(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		rewrites []NameRewrite
+		want     string
+		wantErr  bool
+	}{
+		{name: "mychart", want: "mychart"},
+		{name: "mychart", rewrites: []NameRewrite{{Pattern: "^", Replacement: "team-"}}, want: "team-mychart"},
+		{name: "old-chart", rewrites: []NameRewrite{{Pattern: "^old-", Replacement: ""}, {Pattern: "$", Replacement: "-v2"}}, want: "chart-v2"},
+		{name: "my_chart", rewrites: []NameRewrite{{Pattern: "_", Replacement: "-"}}, want: "my-chart"},
+		{name: "mychart", rewrites: []NameRewrite{{Pattern: "^(.*)$", Replacement: "${1}/sub"}}, wantErr: true},
+		{name: "mychart", rewrites: []NameRewrite{{Pattern: ".*", Replacement: ""}}, wantErr: true},
+	} {
+		t.Run(test.name+" "+test.want, func(t *testing.T) {
+			nameRewrites, err := compileNameRewrites(test.rewrites)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := &Migrator{nameRewrites: nameRewrites}
+
+			name, err := m.rewriteName(test.name)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("rewrote name to %s with error %v, want error %t", name, err, test.wantErr)
+			}
+			if !test.wantErr && name != test.want {
+				t.Errorf("rewrote name to %s, want %s", name, test.want)
+			}
+		})
+	}
+
+	if _, err := compileNameRewrites([]NameRewrite{{Pattern: "(", Replacement: ""}}); err == nil {
+		t.Error("compiled invalid name rewrite pattern")
+	}
+}
+
+func TestRewriteImage(t *testing.T) {
+	rewrites := newImageRewrites(map[string]string{
+		"docker.io":          "registry.example.com/dockerhub",
+		"docker.io/library/": "registry.example.com/library",
+	})
+	for _, test := range []struct {
+		value     string
+		want      string
+		wantMatch bool
+	}{
+		{value: "docker.io", want: "registry.example.com/dockerhub", wantMatch: true},
+		{value: "docker.io/bitnami/nginx:1.25", want: "registry.example.com/dockerhub/bitnami/nginx:1.25", wantMatch: true},
+		{value: "docker.io/library/redis:7", want: "registry.example.com/library/redis:7", wantMatch: true},
+		{value: "docker.io.example.com/nginx", want: "docker.io.example.com/nginx"},
+		{value: "quay.io/prometheus/prometheus", want: "quay.io/prometheus/prometheus"},
+	} {
+		t.Run(test.value, func(t *testing.T) {
+			value, ok := rewriteImage(test.value, rewrites)
+			if value != test.want || ok != test.wantMatch {
+				t.Errorf("rewrote image to %s, match %t, want %s, match %t", value, ok, test.want, test.wantMatch)
+			}
+		})
+	}
+}
+
+func TestRewriteValuesImages(t *testing.T) {
+	rewrites := newImageRewrites(map[string]string{"docker.io": "registry.example.com"})
+
+	values := []byte(`# Image of the chart.
+image:
+  registry: docker.io # the registry
+  repository: bitnami/nginx
+  tag: 1.25
+sidecars:
+  - docker.io/library/busybox:1.36
+docker.io/key: kept
+`)
+	rewritten, err := rewriteValuesImages(values, rewrites)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"# Image of the chart.", "registry: registry.example.com # the registry", "- registry.example.com/library/busybox:1.36", "docker.io/key: kept", "tag: 1.25"} {
+		if !strings.Contains(string(rewritten), want) {
+			t.Errorf("rewritten values.yaml is missing %q:\n%s", want, rewritten)
+		}
+	}
+
+	unchanged, err := rewriteValuesImages([]byte("image: quay.io/nginx\n"), rewrites)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unchanged != nil {
+		t.Errorf("rewrote values.yaml without matching image:\n%s", unchanged)
+	}
+}
+
+func TestRewriteDependencyRepositories(t *testing.T) {
+	chartYAML := []byte(`apiVersion: v2
+name: mychart
+version: 1.0.0
+dependencies:
+  # Shared templates.
+  - name: common
+    version: 2.0.0
+    repository: https://harbor.example.com/chartrepo/library/
+  - name: redis
+    version: 18.0.0
+    repository: https://charts.bitnami.com/bitnami
+`)
+	lock := []byte(`dependencies:
+- name: common
+  repository: https://harbor.example.com/chartrepo/library
+  version: 2.0.0
+- name: redis
+  repository: https://charts.bitnami.com/bitnami
+  version: 18.0.0
+digest: DIGEST
+generated: "2024-01-01T00:00:00Z"
+`)
+	digest, err := dependenciesDigest(chartYAML, lock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock = []byte(strings.Replace(string(lock), "DIGEST", digest, 1))
+	rewrites := map[string]string{"https://harbor.example.com/chartrepo/library": "oci://harbor.example.com/library"}
+
+	rewrittenChartYAML, err := rewriteDependencyRepositories(chartYAML, rewrites)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"# Shared templates.", "repository: oci://harbor.example.com/library\n", "repository: https://charts.bitnami.com/bitnami\n"} {
+		if !strings.Contains(string(rewrittenChartYAML), want) {
+			t.Errorf("rewritten Chart.yaml is missing %q:\n%s", want, rewrittenChartYAML)
+		}
+	}
+
+	rewrittenLock, err := rewriteChartLock(lock, rewrites, chartYAML, rewrittenChartYAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantDigest, err := dependenciesDigest(rewrittenChartYAML, rewrittenLock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wantDigest == digest || !strings.Contains(string(rewrittenLock), "digest: "+wantDigest) {
+		t.Errorf("rewritten Chart.lock does not have the digest %s of the rewritten dependencies:\n%s", wantDigest, rewrittenLock)
+	}
+
+	unchanged, err := rewriteDependencyRepositories(chartYAML, map[string]string{"https://other.example.com": "oci://other.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unchanged != nil {
+		t.Errorf("rewrote Chart.yaml without matching repository:\n%s", unchanged)
+	}
+}
@@ -0,0 +1,89 @@
+package migrate
+
+import (
+	"context"
+	"sync"
+)
+
+// projectSemaphores limit the number of Helm charts of each destination project
+// migrated at once to the PerProjectConcurrency.
+type projectSemaphores struct {
+	limit int
+
+	mutex      sync.Mutex
+	semaphores map[string]chan struct{}
+	// released is signaled when a slot of any project is released.
+	released chan struct{}
+}
+
+func newProjectSemaphores(limit int) *projectSemaphores {
+	return &projectSemaphores{
+		limit:      limit,
+		semaphores: make(map[string]chan struct{}),
+		released:   make(chan struct{}, 1),
+	}
+}
+
+func (s *projectSemaphores) semaphore(project string) chan struct{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	semaphore, ok := s.semaphores[project]
+	if !ok {
+		semaphore = make(chan struct{}, s.limit)
+		s.semaphores[project] = semaphore
+	}
+	return semaphore
+}
+
+// tryAcquire acquires a slot of project unless all of them are taken.
+func (s *projectSemaphores) tryAcquire(project string) bool {
+	select {
+	case s.semaphore(project) <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *projectSemaphores) release(project string) {
+	<-s.semaphore(project)
+	select {
+	case s.released <- struct{}{}:
+	default:
+		// A release is already signaled.
+	}
+}
+
+// scheduleCharts sends helmCharts to helmChartsChan, in order but for the ones
+// of a project with no slot left, which wait for one to be released while the
+// next ones are sent, until ctx is done. The workers release the slot of each
+// Helm chart once processed.
+func (s *projectSemaphores) scheduleCharts(ctx context.Context, helmCharts []HelmChart, helmChartsChan chan<- HelmChart, destinationProject func(HelmChart) string) {
+	pending := append([]HelmChart(nil), helmCharts...)
+	for len(pending) > 0 {
+		scheduled := -1
+		for i, helmChart := range pending {
+			if s.tryAcquire(destinationProject(helmChart)) {
+				scheduled = i
+				break
+			}
+		}
+		if scheduled < 0 {
+			select {
+			case <-s.released:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		helmChart := pending[scheduled]
+		select {
+		case helmChartsChan <- helmChart:
+			pending = append(pending[:scheduled], pending[scheduled+1:]...)
+		case <-ctx.Done():
+			s.release(destinationProject(helmChart))
+			return
+		}
+	}
+}
@@ -0,0 +1,395 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	assistClient "github.com/goharbor/go-client/pkg/sdk/assist/client"
+	"github.com/goharbor/go-client/pkg/sdk/assist/client/chart_repository"
+	"github.com/goharbor/go-client/pkg/sdk/v2.0/client"
+	"github.com/goharbor/go-client/pkg/sdk/v2.0/client/project"
+	"github.com/pkg/errors"
+)
+
+// Values of Options.SourceType.
+const (
+	SourceTypeHarbor      = "harbor"
+	SourceTypeChartMuseum = "chartmuseum"
+)
+
+// ErrNotFound is returned by a ChartSource pulling a file it does not have.
+var ErrNotFound = errors.New("not found")
+
+// ChartSource is a repository the Helm charts are migrated from.
+type ChartSource interface {
+	// Check checks the source is reachable and accepts its credentials.
+	Check(ctx context.Context) error
+	// ListCharts returns all the Helm charts of the source, before filtering.
+	ListCharts(ctx context.Context) ([]HelmChart, error)
+	// PullChart opens the archive of helmChart, returning a retryable error on
+	// a transient failure. The content may have a Size() int64 method returning
+	// its size if known, -1 otherwise.
+	PullChart(ctx context.Context, helmChart HelmChart) (io.ReadCloser, error)
+	// PullProvenance opens the provenance file of helmChart, returning
+	// ErrNotFound when the chart is not signed.
+	PullProvenance(ctx context.Context, helmChart HelmChart) (io.ReadCloser, error)
+	// ChartURL returns the URL of helmChart, as logged by dry runs.
+	ChartURL(helmChart HelmChart) string
+}
+
+// ResumableChartSource is a ChartSource able to resume the interrupted download
+// of a Helm chart archive.
+type ResumableChartSource interface {
+	ChartSource
+	// ResumeChart opens the archive of helmChart from offset, returning the
+	// offset its content actually starts at, 0 when the source sent the whole
+	// archive.
+	ResumeChart(ctx context.Context, helmChart HelmChart, offset int64) (io.ReadCloser, int64, error)
+}
+
+// ReauthenticatingChartSource is a ChartSource able to renew its credentials
+// once they are rejected, e.g. by refreshing an expired token.
+type ReauthenticatingChartSource interface {
+	ChartSource
+	// Reauthenticate renews the credentials of the source, failing if it
+	// cannot.
+	Reauthenticate(ctx context.Context) error
+}
+
+// DeletingChartSource is a ChartSource able to delete its Helm charts, once
+// migrated with Options.DeleteSource.
+type DeletingChartSource interface {
+	ChartSource
+	// DeleteChart deletes the version of helmChart, returning a retryable error
+	// on a transient failure.
+	DeleteChart(ctx context.Context, helmChart HelmChart) error
+}
+
+// sourceCredentials authenticate the downloads from a source with the bearer
+// token if any, renewed by refreshToken if not nil, and with basic auth
+// otherwise.
+type sourceCredentials struct {
+	username     string
+	password     string
+	refreshToken func(context.Context) (string, error)
+
+	mutex sync.RWMutex
+	token string
+}
+
+func newSourceCredentials(username, password, token string, refreshToken func(context.Context) (string, error)) *sourceCredentials {
+	return &sourceCredentials{username: username, password: password, token: token, refreshToken: refreshToken}
+}
+
+// empty tells whether the downloads are anonymous.
+func (c *sourceCredentials) empty() bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.username == "" && c.password == "" && c.token == ""
+}
+
+func (c *sourceCredentials) setAuth(req *http.Request) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+		return
+	}
+	req.SetBasicAuth(c.username, c.password)
+}
+
+// Reauthenticate refreshes the token, only possible with a refreshToken.
+func (c *sourceCredentials) Reauthenticate(ctx context.Context) error {
+	if c.refreshToken == nil {
+		return errors.New("no token refresh configured")
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	token, err := c.refreshToken(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Failed to refresh token")
+	}
+	if token == "" {
+		return errors.New("refreshed token is empty")
+	}
+	c.token = token
+	return nil
+}
+
+// credentialsTransport authenticates the requests sent through transport with
+// the current credentials, so that the API clients of a source use its token
+// once refreshed, like its downloads.
+type credentialsTransport struct {
+	credentials *sourceCredentials
+	transport   http.RoundTripper
+}
+
+func (t *credentialsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	t.credentials.setAuth(req)
+	return t.transport.RoundTrip(req)
+}
+
+// harborSource is the ChartMuseum of a Harbor, its projects being ChartMuseum
+// repositories.
+type harborSource struct {
+	harborURL string
+	*sourceCredentials
+	projects        []string
+	excludeProjects []string
+	apiClient       *harborClient
+	projectList     *projectList
+	httpClient      *http.Client
+}
+
+func (s *harborSource) Check(ctx context.Context) error {
+	return checkHarbor(ctx, s.apiClient.v2)
+}
+
+func (s *harborSource) ListCharts(ctx context.Context) ([]HelmChart, error) {
+	projects, err := projectsToMigrate(ctx, s.projectList, s.projects, s.excludeProjects)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to list projects")
+	}
+
+	helmCharts := make([]HelmChart, 0)
+	for _, projectName := range projects {
+		projectCharts, err := getProjectCharts(ctx, s.apiClient.assist, projectName)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to list Helm charts of project %s", projectName)
+		}
+		helmCharts = append(helmCharts, projectCharts...)
+	}
+
+	return helmCharts, nil
+}
+
+func (s *harborSource) PullChart(ctx context.Context, helmChart HelmChart) (io.ReadCloser, error) {
+	content, _, err := s.download(ctx, s.ChartURL(helmChart), 0)
+	return content, err
+}
+
+func (s *harborSource) ResumeChart(ctx context.Context, helmChart HelmChart, offset int64) (io.ReadCloser, int64, error) {
+	return s.download(ctx, s.ChartURL(helmChart), offset)
+}
+
+func (s *harborSource) PullProvenance(ctx context.Context, helmChart HelmChart) (io.ReadCloser, error) {
+	content, _, err := s.download(ctx, s.ChartURL(helmChart)+provenanceFileSuffix, 0)
+	return content, err
+}
+
+func (s *harborSource) DeleteChart(ctx context.Context, helmChart HelmChart) error {
+	ctx, cancel := contextWithTimeout(ctx, apiTimeout)
+	defer cancel()
+
+	params := chart_repository.NewDeleteChartrepoRepoChartsNameVersionParams().WithRepo(helmChart.Project).WithName(helmChart.Name).WithVersion(helmChart.Version)
+	_, err := s.apiClient.assist.ChartRepository.DeleteChartrepoRepoChartsNameVersion(ctx, params)
+	var unauthorized *chart_repository.DeleteChartrepoRepoChartsNameVersionUnauthorized
+	if errors.As(err, &unauthorized) {
+		return ErrInvalidCredentials
+	}
+	var internalError *chart_repository.DeleteChartrepoRepoChartsNameVersionInternalServerError
+	if errors.As(err, &internalError) {
+		return retryable(err)
+	}
+	return err
+}
+
+func (s *harborSource) ChartURL(helmChart HelmChart) string {
+	return fmt.Sprintf("%s/chartrepo/%s/charts/%s", s.harborURL, helmChart.Project, helmChart.ChartFileName())
+}
+
+func (s *harborSource) download(ctx context.Context, fileURL string, offset int64) (io.ReadCloser, int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	s.setAuth(req)
+	setRange(req, offset)
+
+	res, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := checkDownloadStatus(res); err != nil {
+		res.Body.Close()
+		return nil, 0, err
+	}
+	return newHTTPContent(res, offset)
+}
+
+// httpContent is the body of a file download along with its Content-Length, -1
+// when unknown, and whether the server accepts to resume it.
+type httpContent struct {
+	io.ReadCloser
+	size         int64
+	acceptRanges bool
+}
+
+func (c httpContent) Size() int64 {
+	return c.size
+}
+
+func (c httpContent) AcceptRanges() bool {
+	return c.acceptRanges
+}
+
+// setRange makes req download its file from offset, if not 0.
+func setRange(req *http.Request, offset int64) {
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+}
+
+// newHTTPContent returns the content of the successful response res to the
+// download of a file from offset, along with the offset it actually starts at,
+// 0 when the server ignored the range.
+func newHTTPContent(res *http.Response, offset int64) (io.ReadCloser, int64, error) {
+	content := httpContent{
+		ReadCloser:   res.Body,
+		size:         res.ContentLength,
+		acceptRanges: res.Header.Get("Accept-Ranges") == "bytes",
+	}
+	if res.StatusCode != http.StatusPartialContent {
+		return content, 0, nil
+	}
+
+	if !strings.HasPrefix(res.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+		res.Body.Close()
+		return nil, 0, errors.Errorf("unexpected Content-Range %s of download from offset %d", res.Header.Get("Content-Range"), offset)
+	}
+	content.acceptRanges = true
+	return content, offset, nil
+}
+
+// checkDownloadStatus returns the error of a failed file download response,
+// retryable when the server is overloaded or failing.
+func checkDownloadStatus(res *http.Response) error {
+	if res.StatusCode == http.StatusUnauthorized {
+		return ErrInvalidCredentials
+	}
+
+	if res.StatusCode == http.StatusTooManyRequests {
+		err := fmt.Errorf("received status %d", res.StatusCode)
+		if delay, ok := parseRetryAfter(res.Header.Get("Retry-After"), time.Now()); ok {
+			return retryAfter(err, delay)
+		}
+		return retryable(err)
+	}
+
+	if res.StatusCode >= http.StatusInternalServerError {
+		return retryable(fmt.Errorf("received status %d", res.StatusCode))
+	}
+
+	if res.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("received status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// projectsToMigrate returns the projects, or all the ones of list when empty,
+// minus the excluded ones.
+func projectsToMigrate(ctx context.Context, list *projectList, projects, projectsToExclude []string) ([]string, error) {
+	if len(projects) == 0 {
+		var err error
+		if projects, err = list.get(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	return excludeProjects(projects, projectsToExclude), nil
+}
+
+func excludeProjects(projects, projectsToExclude []string) []string {
+	if len(projectsToExclude) == 0 {
+		return projects
+	}
+
+	excluded := make(map[string]bool, len(projectsToExclude))
+	for _, projectName := range projectsToExclude {
+		excluded[projectName] = true
+	}
+
+	remaining := make([]string, 0, len(projects))
+	for _, projectName := range projects {
+		if !excluded[projectName] {
+			remaining = append(remaining, projectName)
+		}
+	}
+	return remaining
+}
+
+func listProjects(ctx context.Context, apiClient *client.HarborAPI) ([]string, error) {
+	projects := make([]string, 0)
+	pageSize := int64(defaultPageSize)
+	for page := int64(1); ; page++ {
+		pageCtx, cancel := contextWithTimeout(ctx, apiTimeout)
+		res, err := apiClient.Project.ListProjects(pageCtx, project.NewListProjectsParams().WithPage(&page).WithPageSize(&pageSize))
+		cancel()
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to list projects page %d", page)
+		}
+
+		for _, p := range res.Payload {
+			projects = append(projects, p.Name)
+		}
+
+		if isLastPage(len(res.Payload), len(projects), res.XTotalCount) {
+			return projects, nil
+		}
+	}
+}
+
+// isLastPage tells whether a listing is complete after receiving a page of pageLen
+// items, relying on the X-Total-Count header value when Harbor sends it.
+func isLastPage(pageLen, listedCount int, totalCount int64) bool {
+	if pageLen < defaultPageSize {
+		return true
+	}
+	return totalCount > 0 && int64(listedCount) >= totalCount
+}
+
+func getProjectCharts(ctx context.Context, chartClient *assistClient.HarborAPI, projectName string) ([]HelmChart, error) {
+	// The chart repository API of Harbor has no pagination, listing all the
+	// charts of the project, and then all the versions of a chart, at once.
+	listCtx, cancel := contextWithTimeout(ctx, apiTimeout)
+	res, err := chartClient.ChartRepository.GetChartrepoRepoCharts(listCtx, chart_repository.NewGetChartrepoRepoChartsParams().WithRepo(projectName))
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+
+	helmCharts := make([]HelmChart, 0)
+	for _, chart := range res.Payload {
+		chartName := *chart.Name
+		listCtx, cancel := contextWithTimeout(ctx, apiTimeout)
+		versions, err := chartClient.ChartRepository.GetChartrepoRepoChartsName(listCtx, chart_repository.NewGetChartrepoRepoChartsNameParams().WithRepo(projectName).WithName(chartName))
+		cancel()
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to list versions of Helm chart %s", chartName)
+		}
+
+		for _, version := range versions.Payload {
+			helmCharts = append(helmCharts, HelmChart{
+				Name:    chartName,
+				Project: projectName,
+				Version: *version.Version,
+				Digest:  version.Digest,
+			})
+		}
+	}
+
+	return helmCharts, nil
+}
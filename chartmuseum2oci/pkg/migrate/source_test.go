@@ -0,0 +1,146 @@
+package migrate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+)
+
+// newTestHarbor returns a Harbor API server listing projectCount projects,
+// paginated as Harbor does, each of them having chartCount charts of
+// versionCount versions in its ChartMuseum.
+func newTestHarbor(t *testing.T, projectCount, chartCount, versionCount int) *harborClient {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v2.0/projects", func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		pageSize, _ := strconv.Atoi(r.URL.Query().Get("page_size"))
+		projects := make([]map[string]any, 0)
+		for i := (page - 1) * pageSize; i < page*pageSize && i < projectCount; i++ {
+			projects = append(projects, map[string]any{"name": fmt.Sprintf("project-%02d", i)})
+		}
+		w.Header().Set("X-Total-Count", strconv.Itoa(projectCount))
+		writeTestJSON(w, projects)
+	})
+	mux.HandleFunc("/api/chartrepo/", func(w http.ResponseWriter, r *http.Request) {
+		// The path is /api/chartrepo/<repo>/charts[/<name>].
+		segments := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/chartrepo/"), "/")
+		if len(segments) == 2 {
+			charts := make([]map[string]any, 0, chartCount)
+			for i := 0; i < chartCount; i++ {
+				charts = append(charts, map[string]any{"name": fmt.Sprintf("chart-%02d", i)})
+			}
+			writeTestJSON(w, charts)
+			return
+		}
+		versions := make([]map[string]any, 0, versionCount)
+		for i := 0; i < versionCount; i++ {
+			versions = append(versions, map[string]any{"name": segments[2], "version": fmt.Sprintf("1.%d.0", i), "digest": "digest"})
+		}
+		writeTestJSON(w, versions)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	apiClient, err := newHarborClient(server.URL, "user", "password", "", http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return apiClient
+}
+
+func writeTestJSON(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(value)
+}
+
+func TestListProjectsPages(t *testing.T) {
+	for _, projectCount := range []int{0, 1, defaultPageSize, defaultPageSize + 1, 3*defaultPageSize - 2, 3 * defaultPageSize} {
+		t.Run(strconv.Itoa(projectCount), func(t *testing.T) {
+			apiClient := newTestHarbor(t, projectCount, 0, 0)
+
+			projects, err := listProjects(context.Background(), apiClient.v2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(projects) != projectCount {
+				t.Fatalf("listed %d projects, want %d", len(projects), projectCount)
+			}
+			for i, projectName := range projects {
+				if want := fmt.Sprintf("project-%02d", i); projectName != want {
+					t.Errorf("project %d is %s, want %s", i, projectName, want)
+				}
+			}
+		})
+	}
+}
+
+func TestGetProjectCharts(t *testing.T) {
+	apiClient := newTestHarbor(t, 1, 3, 12)
+
+	helmCharts, err := getProjectCharts(context.Background(), apiClient.assist, "project-00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(helmCharts) != 3*12 {
+		t.Fatalf("listed %d Helm charts, want %d", len(helmCharts), 3*12)
+	}
+	want := HelmChart{Name: "chart-02", Project: "project-00", Version: "1.11.0", Digest: "digest"}
+	if !slices.Contains(helmCharts, want) {
+		t.Errorf("missing Helm chart %s", want)
+	}
+}
+
+func TestDeleteChartAfterReauthentication(t *testing.T) {
+	var deletes []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete || r.URL.Path != "/api/chartrepo/library/charts/mychart/1.0.0" {
+			http.NotFound(w, r)
+			return
+		}
+		deletes = append(deletes, r.Header.Get("Authorization"))
+		if r.Header.Get("Authorization") != "Bearer refreshed" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		writeTestJSON(w, map[string]any{})
+	}))
+	defer server.Close()
+
+	m := &Migrator{
+		opts: Options{
+			SourceURL:   server.URL,
+			SourceToken: "expired",
+			SourceTokenRefresher: func(context.Context) (string, error) {
+				return "refreshed", nil
+			},
+		},
+		logger:     slog.New(slog.NewTextHandler(io.Discard, nil)),
+		tracer:     otel.GetTracerProvider().Tracer(tracerName),
+		httpClient: &http.Client{Transport: http.DefaultTransport},
+	}
+	var err error
+	if m.source, err = m.newSource(); err != nil {
+		t.Fatal(err)
+	}
+
+	helmChart := HelmChart{Name: "mychart", Project: "library", Version: "1.0.0"}
+	if err := m.deleteChartFromSource(context.Background(), helmChart); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"Bearer expired", "Bearer refreshed"}
+	if !slices.Equal(deletes, want) {
+		t.Errorf("deletes were authenticated with %q, want %q", deletes, want)
+	}
+}
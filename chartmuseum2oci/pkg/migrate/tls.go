@@ -0,0 +1,93 @@
+package migrate
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+func (m *Migrator) newTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if m.opts.InsecureSkipTLSVerify {
+		//nolint:gosec // explicitly requested through InsecureSkipTLSVerify
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	if len(m.opts.CACertFiles) > 0 {
+		rootCAs, err := m.loadCACerts()
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+
+	if m.opts.ClientCertFile != "" {
+		clientCert, err := tls.LoadX509KeyPair(m.opts.ClientCertFile, m.opts.ClientKeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to load client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{clientCert}
+	}
+
+	return tlsConfig, nil
+}
+
+// loadCACerts returns the system certificate pool completed with the CACertFiles
+// certificates, and writes them to helmCAFile, a bundle removed by Close when
+// there are several of them.
+func (m *Migrator) loadCACerts() (*x509.CertPool, error) {
+	rootCAs, err := x509.SystemCertPool()
+	if err != nil {
+		rootCAs = x509.NewCertPool()
+	}
+
+	bundle := make([]byte, 0)
+	for _, caCertFile := range m.opts.CACertFiles {
+		pem, err := os.ReadFile(caCertFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to read CA certificate %s", caCertFile)
+		}
+		if !rootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("Failed to parse CA certificate %s, no PEM certificate found", caCertFile)
+		}
+		bundle = append(append(bundle, pem...), '\n')
+	}
+
+	if len(m.opts.CACertFiles) == 1 {
+		m.helmCAFile = m.opts.CACertFiles[0]
+		return rootCAs, nil
+	}
+
+	bundleFile, err := os.CreateTemp("", "chartmuseum2oci-ca-*.pem")
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create CA certificate bundle")
+	}
+	defer bundleFile.Close()
+	m.caBundleFile = bundleFile.Name()
+
+	if _, err := bundleFile.Write(bundle); err != nil {
+		return nil, errors.Wrap(err, "Failed to write CA certificate bundle")
+	}
+	m.helmCAFile = bundleFile.Name()
+
+	return rootCAs, nil
+}
+
+// helmTLSArgs returns the TLS arguments of a helm command, insecureFlag being
+// the name of the flag disabling the certificate verification for this command.
+func (m *Migrator) helmTLSArgs(insecureFlag string) []string {
+	args := make([]string, 0)
+	if m.opts.InsecureSkipTLSVerify {
+		args = append(args, insecureFlag)
+	}
+	if m.helmCAFile != "" {
+		args = append(args, "--ca-file", m.helmCAFile)
+	}
+	if m.opts.ClientCertFile != "" {
+		args = append(args, "--cert-file", m.opts.ClientCertFile, "--key-file", m.opts.ClientKeyFile)
+	}
+	return args
+}
@@ -0,0 +1,41 @@
+package migrate
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/pacha5065/chartmuseum-migration-tools/chartmuseum2oci/pkg/migrate"
+
+// Attributes of the spans.
+const (
+	projectKey     = attribute.Key("chart.project")
+	chartKey       = attribute.Key("chart.name")
+	versionKey     = attribute.Key("chart.version")
+	statusKey      = attribute.Key("chart.status")
+	bytesKey       = attribute.Key("chart.bytes")
+	destinationKey = attribute.Key("destination")
+)
+
+// startChartSpan starts the span of the migration of helmChart, the parent of
+// the spans of its pull, pushes and verifications.
+func (m *Migrator) startChartSpan(ctx context.Context, helmChart HelmChart) (context.Context, trace.Span) {
+	return m.tracer.Start(ctx, "migrate chart", trace.WithAttributes(
+		projectKey.String(helmChart.Project),
+		chartKey.String(helmChart.Name),
+		versionKey.String(helmChart.Version),
+	))
+}
+
+// endSpan ends span, setting attrs and recording err if any.
+func endSpan(span trace.Span, err error, attrs ...attribute.KeyValue) {
+	span.SetAttributes(attrs...)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,76 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// verifyPushedChart pulls helmChart back from the destination and checks its
+// SHA256 matches the one of the pushed chart file, i.e. the source one unless
+// the chart was renamed.
+func (d *harborDestination) verifyPushedChart(ctx context.Context, helmChart HelmChart) error {
+	pushedDigest, err := fileDigest(d.m.chartFilePath(helmChart))
+	if err != nil {
+		return errors.Wrap(err, "Failed to compute digest of pushed chart")
+	}
+
+	pullDir, err := os.MkdirTemp(d.m.workDir, "verify-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(pullDir)
+
+	args := []string{"pull", d.destinationRepoURL(helmChart) + "/" + helmChart.DestinationName(), "--version", helmChart.Version, "--destination", pullDir}
+	cmd := d.m.newHelmCommand(ctx, append(args, d.m.helmTLSArgs("--insecure-skip-tls-verify")...)...)
+
+	var stdErr bytes.Buffer
+	cmd.Stderr = &stdErr
+
+	if err := cmd.Run(); err != nil {
+		err = d.m.redactError(errors.Wrapf(err, "Failed to execute helm pull: %s", stdErr.String()))
+		if isRetryableHelmOutput(stdErr.String()) {
+			return retryable(err)
+		}
+		return err
+	}
+
+	pulledFiles, err := filepath.Glob(filepath.Join(pullDir, "*.tgz"))
+	if err != nil {
+		return err
+	}
+	if len(pulledFiles) != 1 {
+		return errors.Errorf("expected 1 chart file pulled from destination, got %d", len(pulledFiles))
+	}
+
+	pulledDigest, err := fileDigest(pulledFiles[0])
+	if err != nil {
+		return errors.Wrap(err, "Failed to compute digest of pulled chart")
+	}
+	if pulledDigest != pushedDigest {
+		return errors.Errorf("digest mismatch, pushed %s but pulled %s", pushedDigest, pulledDigest)
+	}
+
+	return nil
+}
+
+// fileDigest returns the hex encoded SHA256 of the file at filePath.
+func fileDigest(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
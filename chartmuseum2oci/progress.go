@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pacha5065/chartmuseum-migration-tools/chartmuseum2oci/pkg/migrate"
+	"github.com/schollz/progressbar/v3"
+	"golang.org/x/term"
+)
+
+// throughputWindow is the number of the last processed Helm charts the
+// throughput and the ETA are computed from.
+const throughputWindow = 20
+
+// progressLogInterval is the minimum interval between the progress lines logged
+// instead of the progress bar.
+const progressLogInterval = 10 * time.Second
+
+// Values of --progress.
+const (
+	progressAuto   = "auto"
+	progressAlways = "always"
+	progressNever  = "never"
+)
+
+var progressMode string
+
+// showProgressBar tells whether the progress bar is rendered, never with
+// --quiet, --dry-run or --events, and with --progress auto only when its output
+// is a terminal.
+func showProgressBar() bool {
+	switch {
+	case quiet || dryRun || emitEvents || progressMode == progressNever:
+		return false
+	case progressMode == progressAlways:
+		return true
+	default:
+		return isTerminal(progressOutput())
+	}
+}
+
+// logProgressLines tells whether progress lines are logged instead of the
+// progress bar, e.g. in CI logs, which they are with --progress auto when its
+// output is not a terminal.
+func logProgressLines() bool {
+	return progressMode == progressAuto && !dryRun && !emitEvents && !isTerminal(progressOutput())
+}
+
+func isTerminal(file *os.File) bool {
+	return term.IsTerminal(int(file.Fd()))
+}
+
+// progress describes the progress bar of the migration with its throughput, in
+// charts and bytes per second, and its ETA at that rate, or logs it as lines
+// every progressLogInterval with logLines.
+type progress struct {
+	bar      *progressbar.ProgressBar
+	logLines bool
+	count    int
+
+	mutex     sync.Mutex
+	start     time.Time
+	remaining int
+	lastLog   time.Time
+	// completions are the last throughputWindow+1 processed Helm charts, the
+	// first one being the origin of the rate once the window is full.
+	completions []completion
+}
+
+type completion struct {
+	at    time.Time
+	bytes int64
+}
+
+func newProgress(bar *progressbar.ProgressBar, count int, logLines bool) *progress {
+	now := time.Now()
+	return &progress{
+		bar:       bar,
+		logLines:  logLines,
+		count:     count,
+		start:     now,
+		remaining: count,
+		lastLog:   now,
+	}
+}
+
+func (p *progress) chartProcessed(result migrate.ChartResult) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.remaining--
+	p.completions = append(p.completions, completion{at: time.Now(), bytes: result.Bytes})
+	if len(p.completions) > throughputWindow+1 {
+		p.completions = p.completions[1:]
+	}
+
+	description := p.describe()
+	p.bar.Describe(description)
+	p.bar.Add(1)
+
+	if p.logLines && (p.remaining == 0 || time.Since(p.lastLog) >= progressLogInterval) {
+		p.lastLog = time.Now()
+		slog.Info("Migration progress", "processed", fmt.Sprintf("%d/%d", p.count-p.remaining, p.count), "rate", description)
+	}
+}
+
+// describe returns the throughput over the last processed Helm charts and the
+// ETA of the remaining ones at that rate.
+func (p *progress) describe() string {
+	origin := p.start
+	completions := p.completions
+	if len(completions) > throughputWindow {
+		origin = completions[0].at
+		completions = completions[1:]
+	}
+
+	elapsed := completions[len(completions)-1].at.Sub(origin).Seconds()
+	if elapsed <= 0 {
+		return ""
+	}
+	var bytes int64
+	for _, c := range completions {
+		bytes += c.bytes
+	}
+	chartsRate := float64(len(completions)) / elapsed
+	bytesRate := float64(bytes) / elapsed
+
+	description := fmt.Sprintf("%.1f charts/s, %s/s", chartsRate, migrate.FormatSize(int64(bytesRate)))
+	if p.remaining > 0 {
+		eta := time.Duration(float64(p.remaining) / chartsRate * float64(time.Second))
+		description += fmt.Sprintf(", ETA %s", eta.Round(time.Second))
+	}
+	return description
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pacha5065/chartmuseum-migration-tools/chartmuseum2oci/pkg/migrate"
+	"github.com/pkg/errors"
+)
+
+// projectSummary counts the results of the Helm charts of a project.
+type projectSummary struct {
+	Project  string `json:"project"`
+	Total    int    `json:"total"`
+	Migrated int    `json:"migrated"`
+	Skipped  int    `json:"skipped"`
+	Failed   int    `json:"failed"`
+}
+
+// summarizeProjects returns the summary of each project of results, sorted by
+// project name.
+func summarizeProjects(results []migrate.ChartResult) []projectSummary {
+	byProject := make(map[string]*projectSummary)
+	for _, result := range results {
+		summary, ok := byProject[result.Project]
+		if !ok {
+			summary = &projectSummary{Project: result.Project}
+			byProject[result.Project] = summary
+		}
+		summary.Total++
+		switch result.Status {
+		case migrate.StatusMigrated:
+			summary.Migrated++
+		case migrate.StatusSkipped:
+			summary.Skipped++
+		case migrate.StatusFailed:
+			summary.Failed++
+		}
+	}
+
+	summaries := make([]projectSummary, 0, len(byProject))
+	for _, summary := range byProject {
+		summaries = append(summaries, *summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Project < summaries[j].Project
+	})
+	return summaries
+}
+
+// printSummary prints the summary of each project of results, as a table or
+// as a JSON array.
+func printSummary(w io.Writer, results []migrate.ChartResult, output string) error {
+	summaries := summarizeProjects(results)
+
+	switch output {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(summaries)
+	case "table":
+		table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(table, "PROJECT\tTOTAL\tMIGRATED\tSKIPPED\tFAILED")
+		for _, summary := range summaries {
+			fmt.Fprintf(table, "%s\t%d\t%d\t%d\t%d\n", summary.Project, summary.Total, summary.Migrated, summary.Skipped, summary.Failed)
+		}
+		return table.Flush()
+	default:
+		return errors.Errorf("Invalid output %s, must be json or table", output)
+	}
+}
+
+// runTotals counts the results of a migration of Helm charts.
+type runTotals struct {
+	Processed    int    `json:"processed"`
+	Migrated     int    `json:"migrated"`
+	Skipped      int    `json:"skipped"`
+	Failed       int    `json:"failed"`
+	NotProcessed int    `json:"notProcessed"`
+	DurationMs   int64  `json:"durationMs"`
+	Error        string `json:"error,omitempty"`
+}
+
+// newRunTotals returns the totals of the migration of count Helm charts which
+// lasted duration, err being the reason it ended early if any.
+func newRunTotals(count int, results []migrate.ChartResult, duration time.Duration, err error) runTotals {
+	totals := runTotals{
+		Processed:    len(results),
+		NotProcessed: count - len(results),
+		DurationMs:   duration.Milliseconds(),
+	}
+	for _, result := range results {
+		switch result.Status {
+		case migrate.StatusMigrated:
+			totals.Migrated++
+		case migrate.StatusSkipped:
+			totals.Skipped++
+		case migrate.StatusFailed:
+			totals.Failed++
+		}
+	}
+	if err != nil {
+		totals.Error = err.Error()
+	}
+	return totals
+}
+
+// runError returns the reason the migration ended early, nil if it did not.
+func runError(ctx context.Context, summary migrate.Summary, migrateErr error) error {
+	switch {
+	case migrateErr != nil:
+		return migrateErr
+	case summary.AbortCause != nil:
+		return summary.AbortCause
+	case ctx.Err() != nil:
+		return context.Cause(ctx)
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"net/url"
+	"os/exec"
+	"slices"
+
+	"github.com/pacha5065/chartmuseum-migration-tools/chartmuseum2oci/pkg/migrate"
+	"github.com/pkg/errors"
+)
+
+// flagErrors are the errors of the flag values parsed by collectFlagErrors,
+// reported along with the ones of validateFlags instead of stopping the parsing.
+var flagErrors []error
+
+// collectFlagErrors returns the flag.Func of the --name flag parsing its values
+// with parse, recording their errors in flagErrors.
+func collectFlagErrors(name string, parse func(string) error) func(string) error {
+	return func(value string) error {
+		if err := parse(value); err != nil {
+			flagErrors = append(flagErrors, errors.Wrapf(err, "Invalid --%s", name))
+		}
+		return nil
+	}
+}
+
+// validateFlags checks the flags, resolving the ones derived from others, and
+// returns all the errors found so that they can be fixed at once, before any
+// connection to the source or destination.
+func validateFlags() []error {
+	errs := append([]error(nil), flagErrors...)
+	invalid := func(format string, args ...any) {
+		errs = append(errs, errors.Errorf(format, args...))
+	}
+
+	if sourceHarborURL == "" {
+		invalid("Missing required --source-url flag")
+	} else {
+		switch sourceType {
+		case migrate.SourceTypeHarbor:
+			if _, _, err := migrate.NormalizeHarborURL(sourceHarborURL); err != nil {
+				errs = append(errs, errors.Wrap(err, "Invalid --source-url"))
+			}
+		case migrate.SourceTypeChartMuseum:
+			if _, err := migrate.NormalizeChartMuseumURL(sourceHarborURL); err != nil {
+				errs = append(errs, errors.Wrap(err, "Invalid --source-url"))
+			}
+		}
+	}
+	if sourceType != migrate.SourceTypeHarbor && sourceType != migrate.SourceTypeChartMuseum {
+		invalid("Invalid --source-type %s, must be harbor or chartmuseum", sourceType)
+	}
+
+	if sourceAPI != migrate.SourceAPIChartRepo && sourceAPI != migrate.SourceAPIArtifacts {
+		invalid("Invalid --source-api %s, must be v1 or v2", sourceAPI)
+	} else if sourceAPI == migrate.SourceAPIArtifacts {
+		if sourceType != migrate.SourceTypeHarbor {
+			invalid("--source-api v2 requires --source-type harbor")
+		}
+		if deleteSource {
+			invalid("--delete-source is not supported with --source-api v2")
+		}
+	}
+
+	if output != "table" && output != "json" {
+		invalid("Invalid --output %s, must be table or json", output)
+	}
+
+	switch {
+	case listOnly:
+		// The Helm charts are listed without any destination.
+	case destinationType == migrate.DestinationTypeHarbor:
+		if len(destinations) == 0 {
+			invalid("Missing required --destination-url flag")
+		}
+		for i, destination := range destinations {
+			if destination.URL == "" {
+				invalid("Missing --destination-url of destination %d, its credentials being given without it", i+1)
+			} else if _, _, err := migrate.NormalizeHarborURL(destination.URL); err != nil {
+				errs = append(errs, errors.Wrapf(err, "Invalid --destination-url %s", destination.URL))
+			}
+			if destination.Token != "" && (destination.Username != "" || destination.Password != "") {
+				invalid("--destination-token and --destination-username or --destination-password of destination %d are mutually exclusive", i+1)
+			}
+			if destination.Token != "" && pusher != migrate.PusherOCI {
+				invalid("--destination-token of destination %d requires --pusher oci, helm cannot log in with it", i+1)
+			}
+			if (destination.Username == "") != (destination.Password == "") {
+				invalid("--destination-username and --destination-password of destination %d must be specified together, the ones of the first destination defaulting to %s and %s", i+1, destinationUsernameEnv, destinationPasswordEnv)
+			}
+		}
+	case destinationType == migrate.DestinationTypeDir:
+		if destPath == "" {
+			invalid("Missing required --destpath flag of the dir destination")
+		}
+		if len(destinations) > 0 {
+			invalid("--destination-url, --destination-username and --destination-password are not supported with a dir destination")
+		}
+	default:
+		invalid("Invalid --destination-type %s, must be harbor or dir", destinationType)
+	}
+
+	if sourceTokenFile != "" {
+		if sourceToken != "" {
+			invalid("--source-token and --source-token-file are mutually exclusive")
+		} else if token, err := readTokenFile(sourceTokenFile); err != nil {
+			errs = append(errs, errors.Wrap(err, "Invalid --source-token-file"))
+		} else {
+			sourceToken = token
+		}
+	}
+
+	if sourceToken != "" && (sourceHarborUsername != "" || sourceHarborPassword != "") {
+		invalid("--source-token and --source-username or --source-password are mutually exclusive")
+	}
+	if (sourceHarborUsername == "") != (sourceHarborPassword == "") {
+		invalid("--source-username and --source-password must be specified together, defaulting to %s and %s", sourceUsernameEnv, sourcePasswordEnv)
+	}
+
+	if deleteSource {
+		if !confirmDelete {
+			invalid("--delete-source deletes the migrated Helm charts from the source, confirm it with --confirm-delete")
+		}
+		if !verifyPush {
+			invalid("--delete-source requires --verify, only the Helm charts verified in the destination being deleted")
+		}
+	}
+
+	if concurrency < 1 {
+		invalid("--concurrency must be at least 1")
+	}
+	if perProjectConcurrency < 0 {
+		invalid("--per-project-concurrency must not be negative")
+	}
+
+	if pullTimeout < 0 || loginTimeout < 0 || chartTimeout < 0 || deadline < 0 {
+		invalid("--pull-timeout, --login-timeout, --chart-timeout and --deadline must not be negative")
+	}
+
+	if shuffle && listOnly {
+		invalid("--shuffle and --list-only are mutually exclusive, the Helm charts being always listed in a stable order")
+	}
+
+	if startFrom != "" {
+		if _, err := migrate.ParseChartKey(startFrom); err != nil {
+			errs = append(errs, errors.Wrap(err, "Invalid --start-from"))
+		}
+		if shuffle {
+			invalid("--start-from and --shuffle are mutually exclusive, the migration order being random with --shuffle")
+		}
+	}
+
+	if limit < 0 {
+		invalid("--limit must not be negative")
+	}
+
+	if maxRetries < 0 {
+		invalid("--max-retries must not be negative")
+	}
+
+	if insecureSkipTLSVerify && len(caCertFiles) > 0 {
+		invalid("--insecure-skip-tls-verify and --ca-cert are mutually exclusive")
+	}
+
+	if (clientCertFile == "") != (clientKeyFile == "") {
+		invalid("--client-cert and --client-key must be specified together")
+	}
+
+	if latestVersions < 0 {
+		invalid("--latest must not be negative")
+	}
+
+	if failThreshold < 0 || maxConsecutiveFailures < 0 {
+		invalid("--fail-threshold and --max-consecutive-failures must not be negative")
+	}
+
+	if allProjects && sourceType == migrate.SourceTypeChartMuseum {
+		invalid("--all-projects is not supported with a chartmuseum source, which cannot list its repositories")
+	}
+
+	if projectsFile != "" {
+		if projects, err := readProjectsFile(projectsFile); err != nil {
+			errs = append(errs, errors.Wrap(err, "Invalid --projects-file"))
+		} else {
+			for _, project := range projects {
+				if !slices.Contains(projectsToMigrate, project) {
+					projectsToMigrate = append(projectsToMigrate, project)
+				}
+			}
+		}
+	}
+
+	if allProjects && len(projectsToMigrate) > 0 {
+		invalid("--all-projects and --project are mutually exclusive")
+	}
+
+	if flatten {
+		if destPath == "" && destinationType == migrate.DestinationTypeHarbor {
+			invalid("--flatten requires --destpath, its first segment being the destination project")
+		}
+		if len(projectMapping) > 0 {
+			invalid("--flatten and --map are mutually exclusive, the source projects being ignored with --flatten")
+		}
+	}
+
+	if requireDestProjects {
+		if createProjects {
+			invalid("--require-dest-projects and --create-projects are mutually exclusive")
+		}
+		if destinationType != migrate.DestinationTypeHarbor {
+			invalid("--require-dest-projects requires --destination-type harbor")
+		}
+	}
+
+	if pusher != migrate.PusherHelm && pusher != migrate.PusherOCI {
+		invalid("Invalid --pusher %s, must be helm or oci", pusher)
+	}
+
+	if keepChartsDir != "" {
+		if workDir != "" {
+			invalid("--keep-charts-dir and --work-dir are mutually exclusive")
+		}
+		workDir = keepChartsDir
+		keepCharts = true
+	}
+
+	for _, urlFlag := range []struct{ name, value string }{
+		{"pushgateway", pushgatewayURL},
+		{"webhook", webhookURL},
+		{"otlp-endpoint", otlpEndpoint},
+		{"proxy", proxyURL},
+	} {
+		if urlFlag.value == "" {
+			continue
+		}
+		if u, err := url.Parse(urlFlag.value); err != nil || u.Host == "" {
+			invalid("Invalid --%s URL %s, expected scheme://host[:port][/path]", urlFlag.name, urlFlag.value)
+		}
+	}
+
+	if progressMode != progressAuto && progressMode != progressAlways && progressMode != progressNever {
+		invalid("Invalid --progress %s, must be auto, always or never", progressMode)
+	}
+
+	if webhookOn != webhookOnAlways && webhookOn != webhookOnFailure {
+		invalid("Invalid --webhook-on %s, must be always or failure", webhookOn)
+	}
+
+	if !dryRun && !listOnly && pusher == migrate.PusherHelm && destinationType == migrate.DestinationTypeHarbor {
+		resolvedHelmBinaryPath, err := exec.LookPath(helmBinaryPath)
+		if err != nil {
+			errs = append(errs, errors.Wrap(err, "Invalid --helm-binary, install helm or use --pusher oci"))
+		} else {
+			helmBinaryPath = resolvedHelmBinaryPath
+		}
+	}
+
+	return errs
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestValidateFlags(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{name: "valid", args: []string{"--destination-url", "https://harbor.example.com"}},
+		{name: "missing source", args: []string{"--source-url", "", "--destination-url", "https://harbor.example.com"}, wantErr: "Missing required --source-url flag"},
+		{name: "missing destination", wantErr: "Missing required --destination-url flag"},
+		{name: "list only", args: []string{"--list-only"}},
+		{name: "dir without destpath", args: []string{"--destination-type", "dir"}, wantErr: "Missing required --destpath flag of the dir destination"},
+		{name: "invalid map", args: []string{"--destination-url", "https://harbor.example.com", "--map", "library"}, wantErr: "Invalid --map"},
+		{name: "flatten", args: []string{"--destination-url", "https://harbor.example.com", "--flatten", "--destpath", "platform"}},
+		{name: "flatten without destpath", args: []string{"--destination-url", "https://harbor.example.com", "--flatten"}, wantErr: "--flatten requires --destpath"},
+		{name: "flatten dir", args: []string{"--destination-type", "dir", "--destpath", "charts", "--flatten"}},
+		{name: "flatten with map", args: []string{"--destination-url", "https://harbor.example.com", "--flatten", "--destpath", "platform", "--map", "a:b"}, wantErr: "--flatten and --map are mutually exclusive"},
+		{name: "shuffle with list only", args: []string{"--list-only", "--shuffle"}, wantErr: "--shuffle and --list-only are mutually exclusive"},
+		{name: "shuffle with start from", args: []string{"--destination-url", "https://harbor.example.com", "--shuffle", "--start-from", "library/mychart/1.0.0"}, wantErr: "--start-from and --shuffle are mutually exclusive"},
+		{name: "start from nested project", args: []string{"--destination-url", "https://harbor.example.com", "--start-from", "org/team/mychart/1.0.0"}},
+		{name: "invalid start from", args: []string{"--destination-url", "https://harbor.example.com", "--start-from", "mychart/1.0.0"}, wantErr: "Invalid --start-from"},
+		{name: "require and create projects", args: []string{"--destination-url", "https://harbor.example.com", "--require-dest-projects", "--create-projects"}, wantErr: "--require-dest-projects and --create-projects are mutually exclusive"},
+		{name: "delete source unconfirmed", args: []string{"--destination-url", "https://harbor.example.com", "--delete-source", "--verify"}, wantErr: "confirm it with --confirm-delete"},
+		{name: "token with helm", args: []string{"--destination-url", "https://harbor.example.com", "--destination-token", "token", "--pusher", "helm"}, wantErr: "requires --pusher oci"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			initFlags(commands[0])
+			flag.CommandLine.SetOutput(io.Discard)
+			// The oci pusher does not need a helm binary in the PATH.
+			args := append([]string{"--source-url", "https://source.example.com", "--pusher", "oci"}, test.args...)
+			if err := flag.CommandLine.Parse(args); err != nil {
+				t.Fatal(err)
+			}
+
+			errs := validateFlags()
+			if test.wantErr == "" {
+				if len(errs) > 0 {
+					t.Errorf("flags %q are invalid: %v", test.args, errs)
+				}
+				return
+			}
+			for _, err := range errs {
+				if strings.Contains(err.Error(), test.wantErr) {
+					return
+				}
+			}
+			t.Errorf("flags %q have errors %v, want %q", test.args, errs, test.wantErr)
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+
+	"github.com/pacha5065/chartmuseum-migration-tools/chartmuseum2oci/pkg/migrate"
+	"github.com/pkg/errors"
+)
+
+// driftEntry is the JSON entry of a drift printed by the verify command.
+type driftEntry struct {
+	Project           string `json:"project"`
+	Name              string `json:"name"`
+	Version           string `json:"version"`
+	Destination       string `json:"destination"`
+	Problem           string `json:"problem"`
+	SourceDigest      string `json:"sourceDigest,omitempty"`
+	DestinationDigest string `json:"destinationDigest,omitempty"`
+}
+
+// verifyDestinations compares helmCharts with the destinations and prints the
+// drifts found, returning an exitError with exitDriftFound if any.
+func verifyDestinations(ctx context.Context, migrator *migrate.Migrator, helmCharts []migrate.HelmChart) error {
+	slog.Info("Helm charts to verify", "count", len(helmCharts))
+	if countCheck {
+		if err := checkCounts(ctx, migrator, helmCharts); err != nil {
+			return err
+		}
+	}
+	drifts, err := migrator.Compare(ctx, helmCharts)
+	if err != nil {
+		return errors.Wrap(err, "Failed to compare destinations with source")
+	}
+
+	if err := printDrifts(os.Stdout, drifts, output); err != nil {
+		return errors.Wrap(err, "Failed to print drifts")
+	}
+	if len(drifts) > 0 {
+		slog.Error("Destinations do not match source", "charts", len(helmCharts), "drifts", len(drifts))
+		return &exitError{code: exitDriftFound}
+	}
+	slog.Info("Destinations match source", "charts", len(helmCharts))
+	return nil
+}
+
+// checkCounts logs a warning for every destination project whose number of
+// Helm chart versions in a destination differs from the number of helmCharts
+// migrated to it.
+func checkCounts(ctx context.Context, migrator *migrate.Migrator, helmCharts []migrate.HelmChart) error {
+	mismatches, err := migrator.CompareCounts(ctx, helmCharts)
+	if err != nil {
+		return errors.Wrap(err, "Failed to compare Helm chart counts")
+	}
+
+	for _, mismatch := range mismatches {
+		slog.Warn("Helm chart count differs between source and destination", "project", mismatch.Project, "destination", mismatch.Destination, "sourceCount", mismatch.SourceCount, "destinationCount", mismatch.DestinationCount, "delta", mismatch.DestinationCount-mismatch.SourceCount)
+	}
+	if len(mismatches) == 0 {
+		slog.Info("Helm chart counts match between source and destinations")
+	}
+	return nil
+}
+
+// printDrifts prints drifts to w as a table or as JSON.
+func printDrifts(w io.Writer, drifts []migrate.Drift, output string) error {
+	switch output {
+	case "json":
+		entries := make([]driftEntry, 0, len(drifts))
+		for _, drift := range drifts {
+			entries = append(entries, driftEntry{
+				Project:           drift.Project,
+				Name:              drift.Name,
+				Version:           drift.Version,
+				Destination:       drift.Destination,
+				Problem:           drift.Problem,
+				SourceDigest:      drift.SourceDigest,
+				DestinationDigest: drift.DestinationDigest,
+			})
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(entries)
+	case "table":
+		if len(drifts) == 0 {
+			return nil
+		}
+		table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(table, "PROJECT\tNAME\tVERSION\tDESTINATION\tPROBLEM")
+		for _, drift := range drifts {
+			problem := drift.Problem
+			if drift.Problem == migrate.DriftDigestMismatch {
+				problem = fmt.Sprintf("%s (source %s, destination %s)", problem, drift.SourceDigest, drift.DestinationDigest)
+			}
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\n", drift.Project, drift.Name, drift.Version, drift.Destination, problem)
+		}
+		return table.Flush()
+	default:
+		return errors.Errorf("Invalid output %s, must be json or table", output)
+	}
+}
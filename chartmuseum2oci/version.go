@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/pacha5065/chartmuseum-migration-tools/chartmuseum2oci/pkg/migrate"
+)
+
+// version and commit are the version of the tool and the git commit it was built
+// from, set when building a release with
+// -ldflags "-X main.version=... -X main.commit=...".
+var (
+	version = "dev"
+	commit  = ""
+)
+
+// buildCommit returns the commit, or else the VCS revision embedded by go build
+// in a git checkout, unknown without either.
+func buildCommit() string {
+	if commit != "" {
+		return commit
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				return setting.Value
+			}
+		}
+	}
+	return "unknown"
+}
+
+// printVersion prints the version and commit of the tool, the Go version it was
+// built with and the version of the --helm-binary, detected at runtime.
+func printVersion(w io.Writer) {
+	helmVersion, err := migrate.HelmVersion(context.Background(), helmBinaryPath)
+	if err != nil {
+		helmVersion = "not found"
+	}
+
+	fmt.Fprintf(w, "chartmuseum2oci %s\n", version)
+	fmt.Fprintf(w, "commit: %s\n", buildCommit())
+	fmt.Fprintf(w, "go: %s\n", runtime.Version())
+	fmt.Fprintf(w, "helm: %s\n", helmVersion)
+}
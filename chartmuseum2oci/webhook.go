@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pacha5065/chartmuseum-migration-tools/chartmuseum2oci/pkg/migrate"
+	"github.com/pkg/errors"
+)
+
+// Values of --webhook-on.
+const (
+	webhookOnAlways  = "always"
+	webhookOnFailure = "failure"
+)
+
+const (
+	webhookAttempts     = 3
+	webhookTimeout      = 10 * time.Second
+	webhookRetryBackoff = 2 * time.Second
+)
+
+// webhookPayload is the JSON summary POSTed to the --webhook.
+type webhookPayload struct {
+	runTotals
+	// ToolVersion and Commit identify the build of the tool which ran the
+	// migration.
+	ToolVersion string `json:"toolVersion"`
+	Commit      string `json:"commit"`
+	// Failures are the results of the failed Helm charts.
+	Failures []migrate.ChartResult `json:"failures"`
+}
+
+func newWebhookPayload(totals runTotals, results []migrate.ChartResult) webhookPayload {
+	payload := webhookPayload{runTotals: totals, ToolVersion: version, Commit: buildCommit(), Failures: make([]migrate.ChartResult, 0)}
+	for _, result := range results {
+		if result.Status == migrate.StatusFailed {
+			payload.Failures = append(payload.Failures, result)
+		}
+	}
+	return payload
+}
+
+// failed tells whether the migration failed for --webhook-on failure, some Helm
+// chart having failed or the migration having ended early.
+func (p webhookPayload) failed() bool {
+	return p.Failed > 0 || p.Error != ""
+}
+
+// errWebhookRejected is the error of a webhook rejecting the payload with a
+// client error, which would be rejected again.
+var errWebhookRejected = errors.New("webhook rejected the payload")
+
+// notifyWebhook POSTs payload to webhookURL, retrying on network errors, on
+// server errors and when rate limited.
+func notifyWebhook(webhookURL string, payload webhookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: webhookTimeout}
+	for attempt := 1; ; attempt++ {
+		err = postWebhook(client, webhookURL, body)
+		if err == nil || attempt == webhookAttempts || errors.Is(err, errWebhookRejected) {
+			return err
+		}
+		time.Sleep(time.Duration(attempt) * webhookRetryBackoff)
+	}
+}
+
+func postWebhook(client *http.Client, webhookURL string, body []byte) error {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := client.Do(req)
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		// Webhook URLs often hold a secret, e.g. the Slack ones.
+		return urlErr.Err
+	}
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= http.StatusBadRequest && res.StatusCode < http.StatusInternalServerError && res.StatusCode != http.StatusTooManyRequests {
+		return errors.Wrapf(errWebhookRejected, "received status %d", res.StatusCode)
+	}
+	if res.StatusCode < http.StatusOK || res.StatusCode >= http.StatusMultipleChoices {
+		return errors.Errorf("received status %d", res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestNotifyWebhookClientError(t *testing.T) {
+	for _, test := range []struct {
+		status       int
+		wantAttempts int32
+		wantErr      bool
+	}{
+		{status: http.StatusOK, wantAttempts: 1},
+		{status: http.StatusNoContent, wantAttempts: 1},
+		{status: http.StatusBadRequest, wantAttempts: 1, wantErr: true},
+		{status: http.StatusNotFound, wantAttempts: 1, wantErr: true},
+	} {
+		t.Run(http.StatusText(test.status), func(t *testing.T) {
+			var attempts atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				attempts.Add(1)
+				w.WriteHeader(test.status)
+			}))
+			defer server.Close()
+
+			err := notifyWebhook(server.URL, webhookPayload{})
+			if (err != nil) != test.wantErr {
+				t.Errorf("notified webhook with error %v, want error %t", err, test.wantErr)
+			}
+			if count := attempts.Load(); count != test.wantAttempts {
+				t.Errorf("webhook received %d attempts, want %d", count, test.wantAttempts)
+			}
+		})
+	}
+}